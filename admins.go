@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const CHAT_ADMINS_TTL = 10 * time.Minute
+
+type chatAdmins struct {
+	ids     map[int64]bool
+	fetched time.Time
+}
+
+var (
+	globalAdmins   = make(map[string]bool)
+	useChatAdmins  bool
+	chatAdminCache = make(map[int64]chatAdmins)
+	chatAdminMu    sync.Mutex
+)
+
+func normalizeAdmin(entry string) string {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" || strings.HasPrefix(entry, "#") {
+		return ""
+	}
+	if _, err := strconv.ParseInt(entry, 10, 64); err == nil {
+		return entry
+	}
+	return "@" + strings.TrimPrefix(entry, "@")
+}
+
+func loadAdmins() error {
+	globalAdmins = make(map[string]bool)
+	add := func(entry string) {
+		if a := normalizeAdmin(entry); a != "" {
+			globalAdmins[a] = true
+		}
+	}
+	for _, entry := range cfg.Admins {
+		add(entry)
+	}
+	if path := os.Getenv("BOT_ADMINS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			add(sc.Text())
+		}
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	}
+	if len(globalAdmins) == 0 {
+		log.Print("no global admins configured")
+	}
+	useChatAdmins, _ = strconv.ParseBool(os.Getenv("BOT_CHAT_ADMINS"))
+	return nil
+}
+
+func isGlobalAdmin(u *telego.User) bool {
+	if u == nil {
+		return false
+	}
+	if globalAdmins[strconv.FormatInt(u.ID, 10)] {
+		return true
+	}
+	return u.Username != "" && globalAdmins["@"+strings.ToLower(u.Username)]
+}
+
+func isChatAdmin(bot *telego.Bot, ctx context.Context, chatID int64, userID int64) bool {
+	chatAdminMu.Lock()
+	cached, ok := chatAdminCache[chatID]
+	chatAdminMu.Unlock()
+	if ok && time.Since(cached.fetched) < CHAT_ADMINS_TTL {
+		return cached.ids[userID]
+	}
+
+	members, err := bot.GetChatAdministrators(ctx, &telego.GetChatAdministratorsParams{ChatID: tu.ID(chatID)})
+	if err != nil {
+		log.Printf("get chat administrators error: %v", err)
+		return ok && cached.ids[userID]
+	}
+	cached = chatAdmins{ids: make(map[int64]bool), fetched: time.Now()}
+	for _, m := range members {
+		cached.ids[m.MemberUser().ID] = true
+	}
+	chatAdminMu.Lock()
+	chatAdminCache[chatID] = cached
+	chatAdminMu.Unlock()
+	return cached.ids[userID]
+}
+
+func canManageChat(bot *telego.Bot, ctx context.Context, chatID int64, u *telego.User) bool {
+	if isGlobalAdmin(u) {
+		return true
+	}
+	return u != nil && chatID < 0 && isChatAdmin(bot, ctx, chatID, u.ID)
+}
+
+func isAdmin(bot *telego.Bot, ctx context.Context, chatID int64, u *telego.User) bool {
+	if isGlobalAdmin(u) {
+		return true
+	}
+	if !useChatAdmins || u == nil || chatID >= 0 {
+		return false
+	}
+	return isChatAdmin(bot, ctx, chatID, u.ID)
+}
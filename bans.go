@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mymmrac/telego"
+)
+
+const GLOBAL_BAN = 0
+
+type Ban struct {
+	UserID   int64
+	ChatID   int64
+	Reason   string
+	IssuedBy int64
+	Created  time.Time
+	Expires  time.Time
+}
+
+var bans BanStore
+
+func (b Ban) Expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !b.Expires.After(now)
+}
+
+func isBanned(chatID, userID int64) bool {
+	list, err := bans.ListBans(chatID, time.Now())
+	if err != nil {
+		log.Printf("list bans error: %v", err)
+		return false
+	}
+	for _, b := range list {
+		if b.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBanDuration(s string) (time.Duration, bool) {
+	s = strings.ToLower(s)
+	unit, size := utf8.DecodeLastRuneInString(s)
+	n, err := strconv.Atoi(s[:len(s)-size])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	switch unit {
+	case 'm', 'м':
+		return time.Duration(n) * time.Minute, true
+	case 'h', 'ч':
+		return time.Duration(n) * time.Hour, true
+	case 'd', 'д':
+		return time.Duration(n) * 24 * time.Hour, true
+	case 'w', 'н':
+		return time.Duration(n) * 7 * 24 * time.Hour, true
+	}
+	return 0, false
+}
+
+func parseBanArgs(args []string, reply *telego.Message) (target int64, expires time.Time, reason string, ok bool) {
+	if len(args) > 0 {
+		id, found := resolveUserRef(args[0])
+		switch {
+		case found:
+			target = id
+			args = args[1:]
+		case strings.HasPrefix(args[0], "@"):
+			// An unknown @name must not fall through to the replied-to user.
+			return 0, time.Time{}, "", false
+		}
+	}
+	if target == 0 {
+		if reply == nil || reply.From == nil {
+			return 0, time.Time{}, "", false
+		}
+		target = reply.From.ID
+	}
+	if len(args) > 0 {
+		if d, found := parseBanDuration(args[0]); found {
+			expires = time.Now().Add(d)
+			args = args[1:]
+		}
+	}
+	return target, expires, strings.Join(args, " "), true
+}
+
+func userLabel(userID int64) string {
+	u, ok, err := users.LookupUser(userID)
+	if err != nil || !ok {
+		return mention(userID, strconv.FormatInt(userID, 10))
+	}
+	return mention(userID, u.Name)
+}
+
+func formatBans(list []Ban) string {
+	if len(list) == 0 {
+		return "Банов нет"
+	}
+	var sb strings.Builder
+	sb.WriteString("🚫 Баны:\n")
+	for i, b := range list {
+		sb.WriteString(fmt.Sprintf("%d) %s", i+1, userLabel(b.UserID)))
+		if b.ChatID == GLOBAL_BAN {
+			sb.WriteString(" [глобально]")
+		}
+		if b.Reason != "" {
+			sb.WriteString(" — " + html.EscapeString(b.Reason))
+		}
+		if !b.Expires.IsZero() {
+			sb.WriteString(" до " + b.Expires.In(location).Format("02.01.2006 15:04"))
+		}
+		if b.IssuedBy != 0 {
+			sb.WriteString(" (выдал " + userLabel(b.IssuedBy) + ")")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+func TestParseBanArgs(t *testing.T) {
+	fs, err := openFileStore(filepath.Join(t.TempDir(), "rallies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := users
+	defer func() { users = old }()
+	users = fs
+	if err := fs.RememberUser(KnownUser{ID: 7, Username: "vasya", Name: "Вася"}); err != nil {
+		t.Fatal(err)
+	}
+	reply := &telego.Message{From: &telego.User{ID: 9}}
+
+	tests := []struct {
+		args    []string
+		reply   *telego.Message
+		target  int64
+		timed   bool
+		reason  string
+		wantErr bool
+	}{
+		{args: []string{"@vasya", "7d", "флуд"}, target: 7, timed: true, reason: "флуд"},
+		{args: []string{"@Vasya"}, reply: reply, target: 7},
+		{args: []string{"42", "спам"}, target: 42, reason: "спам"},
+		{args: []string{"1h", "спам"}, reply: reply, target: 9, timed: true, reason: "спам"},
+		{args: []string{"спам", "и", "флуд"}, reply: reply, target: 9, reason: "спам и флуд"},
+		{args: []string{"@typo"}, reply: reply, wantErr: true},
+		{args: []string{"@typo", "спам"}, wantErr: true},
+		{args: []string{"спам"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		target, expires, reason, ok := parseBanArgs(tt.args, tt.reply)
+		if ok == tt.wantErr {
+			t.Errorf("parseBanArgs(%q) ok = %v", tt.args, ok)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if target != tt.target || reason != tt.reason || expires.After(time.Now()) != tt.timed {
+			t.Errorf("parseBanArgs(%q) = %d, %v, %q", tt.args, target, expires, reason)
+		}
+	}
+}
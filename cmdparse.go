@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ERR_USAGE          = "usage"
+	ERR_UNCLOSED_QUOTE = "unclosed_quote"
+	ERR_UNKNOWN_OPTION = "unknown_option"
+	ERR_BAD_OPTION     = "bad_option"
+	ERR_NO_NAME        = "no_name"
+	ERR_NO_LIMIT       = "no_limit"
+	ERR_NO_DATE        = "no_date"
+	ERR_EXTRA_WORDS    = "extra_words"
+)
+
+type CmdError struct {
+	Code string
+	Hint string
+}
+
+func (e *CmdError) Error() string {
+	return e.Hint
+}
+
+func cmdErr(code, hint string) *CmdError {
+	return &CmdError{Code: code, Hint: hint}
+}
+
+type rallyCmd struct {
+	Template    string
+	Name        string
+	Limit       int
+	Date        string
+	Description string
+	Place       string
+	Min         int
+	Confirm     int
+	Roles       []Role
+}
+
+type token struct {
+	Text   string
+	Quoted bool
+}
+
+var closingQuotes = map[rune]rune{'"': '"', '«': '»', '“': '”', '„': '“'}
+
+var optionAliases = map[string]string{
+	"limit": "limit", "лимит": "limit",
+	"date": "date", "дата": "date",
+	"time": "time", "время": "time",
+	"place": "place", "место": "place",
+	"min": "min", "минимум": "min",
+	"confirm": "confirm", "подтверждение": "confirm",
+	"roles": "roles", "роли": "roles",
+}
+
+func tokenize(line string) ([]token, error) {
+	var res []token
+	var cur strings.Builder
+	inToken, quoted := false, false
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if closing, ok := closingQuotes[r]; ok {
+			end := -1
+			for k := i + 1; k < len(runes); k++ {
+				if runes[k] == closing {
+					end = k
+					break
+				}
+			}
+			if end == -1 {
+				return nil, cmdErr(ERR_UNCLOSED_QUOTE, "Не закрыта кавычка в команде")
+			}
+			if !inToken {
+				quoted = true
+			}
+			cur.WriteString(string(runes[i+1 : end]))
+			inToken = true
+			i = end
+			continue
+		}
+		if r == ' ' || r == '\t' {
+			if inToken {
+				res = append(res, token{Text: cur.String(), Quoted: quoted})
+				cur.Reset()
+				inToken, quoted = false, false
+			}
+			continue
+		}
+		cur.WriteRune(r)
+		inToken = true
+	}
+	if inToken {
+		res = append(res, token{Text: cur.String(), Quoted: quoted})
+	}
+	return res, nil
+}
+
+func splitOption(t token) (key, value string, ok bool) {
+	if t.Quoted {
+		return "", "", false
+	}
+	i := strings.IndexByte(t.Text, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+	key = strings.ToLower(t.Text[:i])
+	for _, r := range key {
+		if r < 'a' || r > 'z' {
+			if r < 'а' || r > 'я' {
+				return "", "", false
+			}
+		}
+	}
+	return key, t.Text[i+1:], true
+}
+
+func joinTokens(tokens []token) string {
+	parts := make([]string, len(tokens))
+	for i, t := range tokens {
+		parts[i] = t.Text
+	}
+	return strings.Join(parts, " ")
+}
+
+func isDateSuffix(text string) bool {
+	date, _ := splitDeadline(text)
+	_, _, err := parseDateSpec(date, time.Now().In(location))
+	return err == nil
+}
+
+func parseCmdExtras(c *rallyCmd, lines []string) {
+	var desc []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "Место:"):
+			c.Place = strings.TrimSpace(line[len("Место:"):])
+		default:
+			desc = append(desc, line)
+		}
+	}
+	c.Description = strings.Join(desc, "\n")
+}
+
+func parseLegacyPositional(c *rallyCmd, pos []token) error {
+	if len(pos) < 3 {
+		return cmdErr(ERR_USAGE, CMD_USAGE)
+	}
+	limIdx := -1
+	for i := 2; i < len(pos); i++ {
+		if _, e := strconv.Atoi(pos[i-1].Text); e == nil && isDateSuffix(joinTokens(pos[i:])) {
+			limIdx = i - 1
+			break
+		}
+	}
+	if limIdx == -1 {
+		for i := len(pos) - 2; i >= 1; i-- {
+			if _, e := strconv.Atoi(pos[i].Text); e == nil {
+				limIdx = i
+				break
+			}
+		}
+	}
+	if limIdx == -1 {
+		return cmdErr(ERR_NO_LIMIT, "Не найден лимит. Если название заканчивается числом, возьмите его в кавычки: /сбор \"Тур 2\" 12 31.12 21:00 или укажите limit=12")
+	}
+	c.Limit, _ = strconv.Atoi(pos[limIdx].Text)
+	c.Name = strings.TrimSpace(joinTokens(pos[:limIdx]))
+	c.Date = joinTokens(pos[limIdx+1:])
+	return nil
+}
+
+func parseCmd(cmd string) (rallyCmd, error) {
+	lines := strings.Split(cmd, "\n")
+	tokens, err := tokenize(lines[0])
+	if err != nil {
+		return rallyCmd{}, err
+	}
+	if len(tokens) < 2 {
+		return rallyCmd{}, cmdErr(ERR_USAGE, CMD_USAGE)
+	}
+
+	c := rallyCmd{}
+	opts := make(map[string]string)
+	var pos []token
+	for _, t := range tokens[1:] {
+		key, value, ok := splitOption(t)
+		if !ok {
+			pos = append(pos, t)
+			continue
+		}
+		name, known := optionAliases[key]
+		if !known {
+			return rallyCmd{}, cmdErr(ERR_UNKNOWN_OPTION, "Неизвестный параметр «"+key+"». Доступны: limit=, date=, time=, place=, min=, confirm=, roles=")
+		}
+		opts[name] = value
+	}
+
+	if v, ok := opts["limit"]; ok {
+		l, err := strconv.Atoi(v)
+		if err != nil {
+			return rallyCmd{}, cmdErr(ERR_BAD_OPTION, "limit= должен быть числом, например limit=8")
+		}
+		c.Limit = l
+	}
+	if v, ok := opts["min"]; ok {
+		m, err := strconv.Atoi(v)
+		if err != nil || m <= 0 {
+			return rallyCmd{}, cmdErr(ERR_BAD_OPTION, "min= должен быть положительным числом, например min=4")
+		}
+		c.Min = m
+	}
+	if v, ok := opts["confirm"]; ok {
+		m, err := strconv.Atoi(v)
+		if err != nil || m <= 0 || m > CONFIRM_MAX {
+			return rallyCmd{}, cmdErr(ERR_BAD_OPTION, CONFIRM_RANGE_MSG)
+		}
+		c.Confirm = m
+	}
+	if v, ok := opts["roles"]; ok {
+		roles, err := parseRoles(v)
+		if err != nil {
+			return rallyCmd{}, err
+		}
+		if c.Limit != 0 && c.Limit != rolesLimit(roles) {
+			return rallyCmd{}, cmdErr(ERR_BAD_OPTION, ROLES_LIMIT_MSG)
+		}
+		c.Roles = roles
+		c.Limit = rolesLimit(roles)
+	}
+	dateOpt := strings.TrimSpace(opts["date"] + " " + opts["time"])
+
+	switch {
+	case len(pos) > 0 && !pos[0].Quoted && strings.HasPrefix(pos[0].Text, "@"):
+		c.Template = templateKey(pos[0].Text)
+		if c.Template == "" {
+			return rallyCmd{}, cmdErr(ERR_NO_NAME, "Некорректное имя шаблона: "+pos[0].Text)
+		}
+		pos = pos[1:]
+		if c.Limit == 0 && len(pos) > 1 {
+			if l, err := strconv.Atoi(pos[0].Text); err == nil {
+				c.Limit = l
+				pos = pos[1:]
+			}
+		}
+		c.Date = joinTokens(pos)
+	case len(pos) > 0 && pos[0].Quoted:
+		c.Name = pos[0].Text
+		pos = pos[1:]
+		if c.Limit == 0 && len(pos) > 0 {
+			if l, err := strconv.Atoi(pos[0].Text); err == nil {
+				c.Limit = l
+				pos = pos[1:]
+			}
+		}
+		c.Date = joinTokens(pos)
+	case dateOpt != "":
+		c.Name = joinTokens(pos)
+	case c.Limit != 0:
+		split := -1
+		for i := 1; i < len(pos); i++ {
+			if isDateSuffix(joinTokens(pos[i:])) {
+				split = i
+				break
+			}
+		}
+		if split == -1 {
+			return rallyCmd{}, cmdErr(ERR_NO_DATE, "Не удалось найти дату после названия. Укажите её явно: date=\"пт 21:00\"")
+		}
+		c.Name = joinTokens(pos[:split])
+		c.Date = joinTokens(pos[split:])
+	default:
+		if err := parseLegacyPositional(&c, pos); err != nil {
+			return rallyCmd{}, err
+		}
+	}
+
+	if dateOpt != "" {
+		if c.Date != "" {
+			return rallyCmd{}, cmdErr(ERR_EXTRA_WORDS, "Лишние слова «"+c.Date+"»: дата уже задана через date=/time=")
+		}
+		c.Date = dateOpt
+	}
+	if c.Template == "" && strings.TrimSpace(c.Name) == "" {
+		return rallyCmd{}, cmdErr(ERR_NO_NAME, "Не указано название. Пример: /сбор \"Башня\" 8 пт 21:00")
+	}
+	if c.Template == "" && c.Limit == 0 {
+		return rallyCmd{}, cmdErr(ERR_NO_LIMIT, "Не указан лимит. Пример: /сбор \"Башня\" 8 пт 21:00 или limit=8")
+	}
+	if strings.TrimSpace(c.Date) == "" {
+		return rallyCmd{}, cmdErr(ERR_NO_DATE, "Не указана дата. Пример: /сбор \"Башня\" 8 пт 21:00 или date=31.12 time=21:00")
+	}
+	parseCmdExtras(&c, lines[1:])
+	if v, ok := opts["place"]; ok {
+		c.Place = v
+	}
+	return c, nil
+}
+
+func parseCmdDefaultLimit(cmd string, defaultLimit int) (rallyCmd, error) {
+	c, err := parseCmd(cmd)
+	var cerr *CmdError
+	if err == nil || defaultLimit <= 0 || !errors.As(err, &cerr) || (cerr.Code != ERR_NO_LIMIT && cerr.Code != ERR_USAGE) {
+		return c, err
+	}
+	first, rest, _ := strings.Cut(cmd, "\n")
+	withLimit := first + " limit=" + strconv.Itoa(defaultLimit)
+	if rest != "" {
+		withLimit += "\n" + rest
+	}
+	if c, retryErr := parseCmd(withLimit); retryErr == nil {
+		return c, nil
+	}
+	return c, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []token
+	}{
+		{"/сбор Башня 8", []token{{Text: "/сбор"}, {Text: "Башня"}, {Text: "8"}}},
+		{"  a \t b  ", []token{{Text: "a"}, {Text: "b"}}},
+		{`/сбор "Тур 2" 8`, []token{{Text: "/сбор"}, {Text: "Тур 2", Quoted: true}, {Text: "8"}}},
+		{"/сбор «Башня в ГУМе» 8", []token{{Text: "/сбор"}, {Text: "Башня в ГУМе", Quoted: true}, {Text: "8"}}},
+		{"/сбор “a b” „c d“", []token{{Text: "/сбор"}, {Text: "a b", Quoted: true}, {Text: "c d", Quoted: true}}},
+		{`place="ГУМ, 3 этаж"`, []token{{Text: "place=ГУМ, 3 этаж"}}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := tokenize(tt.in)
+		if err != nil {
+			t.Errorf("tokenize(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTokenizeUnclosedQuote(t *testing.T) {
+	_, err := tokenize(`/сбор "Башня 8 пт`)
+	var cerr *CmdError
+	if !errors.As(err, &cerr) || cerr.Code != ERR_UNCLOSED_QUOTE {
+		t.Errorf("err = %v, want %s", err, ERR_UNCLOSED_QUOTE)
+	}
+}
+
+func TestParseCmd(t *testing.T) {
+	tests := []struct {
+		in   string
+		want rallyCmd
+	}{
+		{"/сбор Башня в ГУМЕ 12 31.12.2099 21:00", rallyCmd{Name: "Башня в ГУМЕ", Limit: 12, Date: "31.12.2099 21:00"}},
+		{"/party Путешествие на тот свет 2 12.11", rallyCmd{Name: "Путешествие на тот свет", Limit: 2, Date: "12.11"}},
+		{"/сбор Рейд 8 пт 20:00", rallyCmd{Name: "Рейд", Limit: 8, Date: "пт 20:00"}},
+		{"/сбор Кино 4 завтра 19:00", rallyCmd{Name: "Кино", Limit: 4, Date: "завтра 19:00"}},
+		{"/сбор Пицца 3 через 2 часа", rallyCmd{Name: "Пицца", Limit: 3, Date: "через 2 часа"}},
+		{"/сбор Башня 8 через 2 часа", rallyCmd{Name: "Башня", Limit: 8, Date: "через 2 часа"}},
+		{"/сбор Поход 10 через 3 дня", rallyCmd{Name: "Поход", Limit: 10, Date: "через 3 дня"}},
+		{"/сбор Тур 2 12 31.12 21:00", rallyCmd{Name: "Тур 2", Limit: 12, Date: "31.12 21:00"}},
+		{"/сбор Рейд 8 пт 20:00 запись до 18:00", rallyCmd{Name: "Рейд", Limit: 8, Date: "пт 20:00 запись до 18:00"}},
+		{`/сбор "Тур 2 Башня 12" 8 31.12 21:00`, rallyCmd{Name: "Тур 2 Башня 12", Limit: 8, Date: "31.12 21:00"}},
+		{"/сбор Тур 2 limit=8 пт 21:00", rallyCmd{Name: "Тур 2", Limit: 8, Date: "пт 21:00"}},
+		{"/сбор Башня лимит=8 дата=пт время=21:00", rallyCmd{Name: "Башня", Limit: 8, Date: "пт 21:00"}},
+		{`/сбор Башня limit=8 date=пт time=21:00 place="ГУМ, 3 этаж" min=4`, rallyCmd{Name: "Башня", Limit: 8, Date: "пт 21:00", Place: "ГУМ, 3 этаж", Min: 4}},
+		{"/сбор Рейд 8 пт 20:00 confirm=30", rallyCmd{Name: "Рейд", Limit: 8, Date: "пт 20:00", Confirm: 30}},
+		{"/сбор Рейд роли=танк:2,хил:1 пт 21:00", rallyCmd{Name: "Рейд", Limit: 3, Date: "пт 21:00", Roles: []Role{{Name: "танк", Limit: 2}, {Name: "хил", Limit: 1}}}},
+		{"/сбор @рейд пт 21:00", rallyCmd{Template: "рейд", Date: "пт 21:00"}},
+		{"/сбор @рейд 10 пт 21:00", rallyCmd{Template: "рейд", Limit: 10, Date: "пт 21:00"}},
+		{"/сбор Шашлыки 10 сб 14:00\nМесто: дача у Пети\nБерём мясо\nи угли", rallyCmd{Name: "Шашлыки", Limit: 10, Date: "сб 14:00", Place: "дача у Пети", Description: "Берём мясо\nи угли"}},
+	}
+	for _, tt := range tests {
+		got, err := parseCmd(tt.in)
+		if err != nil {
+			t.Errorf("parseCmd(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCmd(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseCmdErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		code string
+	}{
+		{"/сбор", ERR_USAGE},
+		{"/сбор Башня", ERR_USAGE},
+		{"/сбор Башня пт 21:00", ERR_NO_LIMIT},
+		{"/сбор Башня 8 пт 21:00 foo=1", ERR_UNKNOWN_OPTION},
+		{"/сбор Башня limit=x пт 21:00", ERR_BAD_OPTION},
+		{"/сбор Башня 8 пт 21:00 min=0", ERR_BAD_OPTION},
+		{"/сбор Башня limit=8 непонятно когда", ERR_NO_DATE},
+		{`/сбор "Башня" 8 пт date=сб`, ERR_EXTRA_WORDS},
+		{`/сбор "Башня" 8`, ERR_NO_DATE},
+		{"/сбор Рейд limit=5 роли=танк:2,хил:1 пт 21:00", ERR_BAD_OPTION},
+	}
+	for _, tt := range tests {
+		_, err := parseCmd(tt.in)
+		var cerr *CmdError
+		if !errors.As(err, &cerr) || cerr.Code != tt.code {
+			t.Errorf("parseCmd(%q) error = %v, want code %s", tt.in, err, tt.code)
+		}
+	}
+}
+
+func TestParseCmdDefaultLimit(t *testing.T) {
+	c, err := parseCmdDefaultLimit("/сбор Башня пт 21:00", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "Башня" || c.Limit != 6 || c.Date != "пт 21:00" {
+		t.Errorf("got %+v", c)
+	}
+	if _, err := parseCmdDefaultLimit("/сбор Башня пт 21:00", 0); err == nil {
+		t.Error("expected an error without a default limit")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_CONFIG   = "config.toml"
+	LIMIT_HARD_MAX   = 100
+	FRIENDS_HARD_MAX = 20
+)
+
+type Config struct {
+	LimitMin           int
+	LimitMax           int
+	MaxPlusFriends     int
+	Admins             []string
+	EditInterval       time.Duration
+	GlobalEditInterval time.Duration
+	MinDecision        time.Duration
+	ArchiveAfter       time.Duration
+	Emoji              map[string]string
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		LimitMin:           2,
+		LimitMax:           30,
+		MaxPlusFriends:     4,
+		EditInterval:       1100 * time.Millisecond,
+		GlobalEditInterval: 35 * time.Millisecond,
+		MinDecision:        2 * time.Hour,
+		ArchiveAfter:       30 * 24 * time.Hour,
+		Emoji: map[string]string{
+			"rally":     "5310228579009699834",
+			"date":      "5433614043006903194",
+			"limit":     "5373335654476294839",
+			"initiator": "5373012449597335010",
+			"signup":    "5470060791883374114",
+			"waiting":   "5451646226975955576",
+			"pencil":    "5334673106202010226",
+			"unsign":    "5188365693803830912",
+			"cancel":    "5465665476971471368",
+			"resume":    "5264727218734524899",
+		},
+	}
+}
+
+func emoji(key, fallback string) string {
+	id := cfg.Emoji[key]
+	if id == "" {
+		return fallback
+	}
+	return fmt.Sprintf("<tg-emoji emoji-id=\"%s\">%s</tg-emoji>", id, fallback)
+}
+
+func unquoteConfig(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1], nil
+	}
+	return strconv.Unquote(s)
+}
+
+func stripConfigComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigArray(s string) ([]string, error) {
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	var res []string
+	for s != "" {
+		if s[0] != '"' && s[0] != '\'' {
+			return nil, fmt.Errorf("array items must be quoted strings")
+		}
+		end := 1
+		for end < len(s) && s[end] != s[0] {
+			if s[end] == '\\' && s[0] == '"' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return nil, fmt.Errorf("unterminated string in array")
+		}
+		item, err := unquoteConfig(s[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, item)
+		s = strings.TrimSpace(s[end+1:])
+		if s == "" {
+			break
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("expected comma in array")
+		}
+		s = strings.TrimSpace(s[1:])
+	}
+	return res, nil
+}
+
+func parseConfigFile(path string) (map[string]any, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]any)
+	section := ""
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripConfigComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1:len(line)-1]) + "."
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key, raw = section+strings.TrimSpace(key), strings.TrimSpace(raw)
+		var v any
+		switch {
+		case strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]"):
+			v, err = parseConfigArray(raw)
+		case strings.HasPrefix(raw, "\"") || strings.HasPrefix(raw, "'"):
+			v, err = unquoteConfig(raw)
+		case raw == "true" || raw == "false":
+			v = raw == "true"
+		default:
+			v, err = strconv.Atoi(raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad value for %s: %v", path, n, key, err)
+		}
+		values[key] = v
+	}
+	return values, sc.Err()
+}
+
+func configInt(key string, v any, dst *int) error {
+	n, ok := v.(int)
+	if !ok {
+		return fmt.Errorf("%s must be an integer", key)
+	}
+	*dst = n
+	return nil
+}
+
+func configDuration(key string, v any, dst *time.Duration) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%s must be a duration string like \"1100ms\"", key)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	*dst = d
+	return nil
+}
+
+func (c *Config) apply(key string, v any) error {
+	if name, ok := strings.CutPrefix(key, "emoji."); ok {
+		if _, known := c.Emoji[name]; !known {
+			return fmt.Errorf("unknown emoji %q", name)
+		}
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", key)
+		}
+		c.Emoji[name] = s
+		return nil
+	}
+	switch key {
+	case "limit_min":
+		return configInt(key, v, &c.LimitMin)
+	case "limit_max":
+		return configInt(key, v, &c.LimitMax)
+	case "max_friends":
+		return configInt(key, v, &c.MaxPlusFriends)
+	case "edit_interval":
+		return configDuration(key, v, &c.EditInterval)
+	case "global_edit_interval":
+		return configDuration(key, v, &c.GlobalEditInterval)
+	case "min_decision":
+		return configDuration(key, v, &c.MinDecision)
+	case "archive_after":
+		return configDuration(key, v, &c.ArchiveAfter)
+	case "admins":
+		list, ok := v.([]string)
+		if !ok {
+			return fmt.Errorf("admins must be an array of strings")
+		}
+		c.Admins = list
+		return nil
+	}
+	return fmt.Errorf("unknown setting %q", key)
+}
+
+func (c *Config) applyEnv() error {
+	ints := map[string]string{"BOT_LIMIT_MIN": "limit_min", "BOT_LIMIT_MAX": "limit_max", "BOT_MAX_FRIENDS": "max_friends"}
+	for env, key := range ints {
+		if s := os.Getenv(env); s != "" {
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("%s must be an integer", env)
+			}
+			if err := c.apply(key, n); err != nil {
+				return err
+			}
+		}
+	}
+	durations := map[string]string{"BOT_EDIT_INTERVAL": "edit_interval", "BOT_GLOBAL_EDIT_INTERVAL": "global_edit_interval", "BOT_MIN_DECISION": "min_decision", "BOT_ARCHIVE_AFTER": "archive_after"}
+	for env, key := range durations {
+		if s := os.Getenv(env); s != "" {
+			if err := c.apply(key, strings.TrimSpace(s)); err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+	if s := os.Getenv("BOT_ADMINS"); s != "" {
+		c.Admins = strings.FieldsFunc(s, func(r rune) bool {
+			return r == ',' || r == ' ' || r == ';'
+		})
+	}
+	for name := range c.Emoji {
+		if id, ok := os.LookupEnv("BOT_EMOJI_" + strings.ToUpper(name)); ok {
+			c.Emoji[name] = strings.TrimSpace(id)
+		}
+	}
+	return nil
+}
+
+func (c Config) validate() error {
+	var errs []error
+	if c.LimitMin < 1 || c.LimitMin > c.LimitMax || c.LimitMax > LIMIT_HARD_MAX {
+		errs = append(errs, fmt.Errorf("limits must satisfy 1 <= limit_min <= limit_max <= %d", LIMIT_HARD_MAX))
+	}
+	if c.MaxPlusFriends < 0 || c.MaxPlusFriends > FRIENDS_HARD_MAX {
+		errs = append(errs, fmt.Errorf("max_friends must be between 0 and %d", FRIENDS_HARD_MAX))
+	}
+	if c.EditInterval <= 0 || c.GlobalEditInterval <= 0 {
+		errs = append(errs, errors.New("edit intervals must be positive"))
+	}
+	if c.MinDecision < 0 {
+		errs = append(errs, errors.New("min_decision must not be negative"))
+	}
+	if c.ArchiveAfter < 0 {
+		errs = append(errs, errors.New("archive_after must not be negative"))
+	}
+	names := make([]string, 0, len(c.Emoji))
+	for name := range c.Emoji {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if id := c.Emoji[name]; id != "" {
+			if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+				errs = append(errs, fmt.Errorf("emoji.%s must be a numeric custom emoji id", name))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func loadConfig() (Config, error) {
+	c := defaultConfig()
+	path, explicit := os.LookupEnv("CONFIG_PATH")
+	if !explicit {
+		path = DEFAULT_CONFIG
+	}
+	values, err := parseConfigFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !explicit:
+	case err != nil:
+		return c, err
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := c.apply(key, values[key]); err != nil {
+			return c, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultConfigHasNoAdmins(t *testing.T) {
+	if admins := defaultConfig().Admins; len(admins) != 0 {
+		t.Errorf("default admins = %v, want none", admins)
+	}
+}
+
+func TestLoadConfigExample(t *testing.T) {
+	t.Setenv("CONFIG_PATH", "config.example.toml")
+	t.Setenv("BOT_ADMINS", "")
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Admins) != 0 {
+		t.Errorf("example admins = %v, want none", c.Admins)
+	}
+}
+
+func TestLoadAdminsWithoutConfig(t *testing.T) {
+	old := cfg
+	defer func() { cfg = old }()
+	cfg = defaultConfig()
+	path := filepath.Join(t.TempDir(), "admins.txt")
+	if err := os.WriteFile(path, []byte("# bot admins\n@Someone\n42\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BOT_ADMINS_FILE", path)
+	if err := loadAdmins(); err != nil {
+		t.Fatal(err)
+	}
+	if len(globalAdmins) != 2 || !globalAdmins["@someone"] || !globalAdmins["42"] {
+		t.Errorf("globalAdmins = %v", globalAdmins)
+	}
+
+	t.Setenv("BOT_ADMINS_FILE", "")
+	if err := loadAdmins(); err != nil {
+		t.Fatal(err)
+	}
+	if len(globalAdmins) != 0 {
+		t.Errorf("globalAdmins = %v, want none", globalAdmins)
+	}
+}
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want map[string]any
+		err  string
+	}{
+		{name: "comments", text: "# header\n\nlimit_min = 3 # inline\n  # indented\n", want: map[string]any{"limit_min": 3}},
+		{name: "hash in quotes", text: `edit_interval = "1s#x" # real comment`, want: map[string]any{"edit_interval": "1s#x"}},
+		{name: "escaped quote", text: `min_decision = "a\"#b"`, want: map[string]any{"min_decision": `a"#b`}},
+		{name: "single quotes", text: `min_decision = 'C:\dir#1'`, want: map[string]any{"min_decision": `C:\dir#1`}},
+		{name: "bool", text: "debug = true", want: map[string]any{"debug": true}},
+		{name: "array", text: `admins = ["@a", '42' , "x,y"]`, want: map[string]any{"admins": []string{"@a", "42", "x,y"}}},
+		{name: "empty array", text: "admins = [ ]", want: map[string]any{"admins": []string(nil)}},
+		{name: "section", text: "limit_max = 5\n[emoji]\nrally = \"1\"", want: map[string]any{"limit_max": 5, "emoji.rally": "1"}},
+		{name: "no value", text: "limit_min", err: "config.toml:1: expected key = value"},
+		{name: "bare word", text: "\nlimit_min = three", err: "config.toml:2: bad value for limit_min"},
+		{name: "unterminated string", text: `edit_interval = "1s`, err: "bad value for edit_interval"},
+		{name: "unquoted array item", text: "admins = [@a]", err: "array items must be quoted strings"},
+		{name: "missing comma", text: `admins = ["@a" "@b"]`, err: "expected comma in array"},
+		{name: "unterminated array item", text: `admins = ["@a]`, err: "unterminated string in array"},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigFile(writeConfig(t, tt.text))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	tests := []struct {
+		key string
+		v   any
+		err string
+	}{
+		{"limit_max", 50, ""},
+		{"edit_interval", "2s", ""},
+		{"admins", []string{"@a"}, ""},
+		{"emoji.rally", "", ""},
+		{"limit_mxa", 50, `unknown setting "limit_mxa"`},
+		{"emoji.party", "1", `unknown emoji "party"`},
+		{"limit_min", "3", "limit_min must be an integer"},
+		{"max_friends", true, "max_friends must be an integer"},
+		{"edit_interval", 5, "edit_interval must be a duration string"},
+		{"min_decision", "soon", "min_decision: time: invalid duration"},
+		{"admins", "@a", "admins must be an array of strings"},
+		{"emoji.rally", 1, "emoji.rally must be a string"},
+	}
+	for _, tt := range tests {
+		c := defaultConfig()
+		err := c.apply(tt.key, tt.v)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s = %v: %v", tt.key, tt.v, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s = %v: err = %v, want %q", tt.key, tt.v, err, tt.err)
+		}
+	}
+}
+
+func TestConfigEnvOverrides(t *testing.T) {
+	t.Setenv("CONFIG_PATH", writeConfig(t, "limit_max = 20\nedit_interval = \"1s\"\nadmins = [\"@file\"]\n"))
+	t.Setenv("BOT_LIMIT_MAX", " 50 ")
+	t.Setenv("BOT_EDIT_INTERVAL", "2s")
+	t.Setenv("BOT_ADMINS", "@a, 42;@b")
+	t.Setenv("BOT_EMOJI_RALLY", "")
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LimitMax != 50 || c.EditInterval != 2*time.Second {
+		t.Errorf("limit_max = %d, edit_interval = %v", c.LimitMax, c.EditInterval)
+	}
+	if !reflect.DeepEqual(c.Admins, []string{"@a", "42", "@b"}) {
+		t.Errorf("admins = %v", c.Admins)
+	}
+	if c.Emoji["rally"] != "" || c.Emoji["date"] == "" {
+		t.Errorf("emoji = %v", c.Emoji)
+	}
+
+	t.Setenv("BOT_MAX_FRIENDS", "many")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "BOT_MAX_FRIENDS must be an integer") {
+		t.Errorf("bad BOT_MAX_FRIENDS: err = %v", err)
+	}
+	t.Setenv("BOT_MAX_FRIENDS", "")
+	t.Setenv("BOT_MIN_DECISION", "soon")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "BOT_MIN_DECISION: min_decision") {
+		t.Errorf("bad BOT_MIN_DECISION: err = %v", err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		err  string
+	}{
+		{"limit_mxa = 50", `unknown setting "limit_mxa"`},
+		{"limit_min = 0", "limits must satisfy"},
+		{"limit_min = 10\nlimit_max = 5", "limits must satisfy"},
+		{"limit_max = 101", "limits must satisfy"},
+		{"max_friends = -1", "max_friends must be between 0 and 20"},
+		{"max_friends = 21", "max_friends must be between 0 and 20"},
+		{`global_edit_interval = "0s"`, "edit intervals must be positive"},
+		{`min_decision = "-1h"`, "min_decision must not be negative"},
+		{`archive_after = "-1h"`, "archive_after must not be negative"},
+		{"[emoji]\ndate = \"abc\"", "emoji.date must be a numeric custom emoji id"},
+	}
+	for _, tt := range tests {
+		t.Setenv("CONFIG_PATH", writeConfig(t, tt.text))
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: err = %v, want %q", tt.text, err, tt.err)
+		}
+	}
+
+	t.Setenv("CONFIG_PATH", filepath.Join(t.TempDir(), "missing.toml"))
+	if _, err := loadConfig(); err == nil {
+		t.Error("expected an error for a missing explicit config")
+	}
+	c := defaultConfig()
+	c.MaxPlusFriends = 0
+	if err := c.validate(); err != nil {
+		t.Errorf("max_friends = 0: %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	CONFIRM_PREFIX    = "cf:"
+	CONFIRM_MAX       = 24 * 60
+	CONFIRM_RANGE_MSG = "confirm= должен быть от 1 до 1440 минут, например confirm=30"
+	CONFIRM_DONE      = "Участие подтверждено"
+	CONFIRM_NOTHING   = "Вам нечего подтверждать"
+	NOTIFY_CONFIRM    = "🎉 Место освободилось: вы в основном составе сбора «%s» (%s). Подтвердите участие до %s, иначе место перейдёт следующему в листе ожидания"
+	NOTIFY_DROPPED    = "⌛ Вы не подтвердили участие в сборе «%s» (%s) — место передано следующему, вы в конце листа ожидания"
+)
+
+type Pending struct {
+	UserID int64
+	N      int
+	Until  time.Time
+}
+
+func findPending(r Rally, userID int64, n int) int {
+	for i, p := range r.Pending {
+		if p.UserID == userID && p.N == n {
+			return i
+		}
+	}
+	return -1
+}
+
+func markPending(r *Rally, e Entry, now time.Time) {
+	if r.ConfirmMinutes <= 0 || e.UserID == 0 || findPending(*r, e.UserID, e.N) != -1 {
+		return
+	}
+	r.Pending = append(r.Pending, Pending{
+		UserID: e.UserID,
+		N:      e.N,
+		Until:  now.Add(time.Duration(r.ConfirmMinutes) * time.Minute),
+	})
+}
+
+func prunePending(r *Rally) {
+	res := r.Pending[:0]
+	for _, p := range r.Pending {
+		for _, e := range r.SignedUp {
+			if e.UserID == p.UserID && e.N == p.N {
+				res = append(res, p)
+				break
+			}
+		}
+	}
+	r.Pending = res
+}
+
+func confirmPending(r *Rally, userID int64) []Pending {
+	var confirmed []Pending
+	res := r.Pending[:0]
+	for _, p := range r.Pending {
+		if p.UserID == userID {
+			confirmed = append(confirmed, p)
+			continue
+		}
+		res = append(res, p)
+	}
+	r.Pending = res
+	return confirmed
+}
+
+func confirmJobID(r Rally, p Pending) string {
+	return jobID(r, fmt.Sprintf("%s:%d:%d", JOB_CONFIRM, p.UserID, p.N))
+}
+
+func armConfirmJobs(r Rally) {
+	if r.Status != STATUS_OPEN && r.Status != STATUS_CLOSED {
+		return
+	}
+	for _, p := range r.Pending {
+		err := jobs.AddJob(Job{
+			ID:              confirmJobID(r, p),
+			Kind:            JOB_CONFIRM,
+			ChatID:          r.ChatID,
+			MessageID:       r.MessageID,
+			InlineMessageID: r.InlineMessageID,
+			UserID:          p.UserID,
+			N:               p.N,
+			At:              p.Until,
+		})
+		if err != nil {
+			log.Printf("jobs add error: %v", err)
+		}
+	}
+}
+
+func dropConfirmJobs(r Rally, confirmed []Pending) {
+	for _, p := range confirmed {
+		if err := jobs.DeleteJob(confirmJobID(r, p)); err != nil {
+			log.Printf("jobs delete error: %v", err)
+		}
+	}
+}
+
+func pendingUntil(r Rally, e Entry) (time.Time, bool) {
+	if i := findPending(r, e.UserID, e.N); i != -1 && e.UserID != 0 {
+		return r.Pending[i].Until, true
+	}
+	return time.Time{}, false
+}
+
+func confirmData(r Rally) string {
+	if r.InlineMessageID != "" {
+		return CONFIRM_PREFIX + "i:" + r.InlineMessageID
+	}
+	return fmt.Sprintf("%s%d:%d", CONFIRM_PREFIX, r.ChatID, r.MessageID)
+}
+
+func parseConfirmData(data string) (chatID int64, messageID int, inlineID string, ok bool) {
+	rest := strings.TrimPrefix(data, CONFIRM_PREFIX)
+	if id, found := strings.CutPrefix(rest, "i:"); found {
+		return 0, 0, id, id != ""
+	}
+	chat, msg, found := strings.Cut(rest, ":")
+	if !found {
+		return 0, 0, "", false
+	}
+	chatID, err := strconv.ParseInt(chat, 10, 64)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	messageID, err = strconv.Atoi(msg)
+	if err != nil {
+		return 0, 0, "", false
+	}
+	return chatID, messageID, "", true
+}
+
+func confirmLockKey(data string) (string, bool) {
+	chatID, messageID, inlineID, ok := parseConfirmData(data)
+	switch {
+	case !ok:
+		return "", false
+	case inlineID != "":
+		return inlineLockKey(inlineID), true
+	}
+	return rallyLockKey(chatID, messageID), true
+}
+
+func confirmButton(data string) telego.InlineKeyboardButton {
+	return tu.InlineKeyboardButton("Подтверждаю").
+		WithCallbackData(data).
+		WithStyle("success").
+		WithIconCustomEmojiID(cfg.Emoji["signup"])
+}
+
+func confirmMarkup(r Rally) *telego.InlineKeyboardMarkup {
+	return tu.InlineKeyboard(tu.InlineKeyboardRow(confirmButton(confirmData(r))))
+}
+
+func dropConfirmButton(bot *telego.Bot, ctx context.Context, cb *telego.CallbackQuery) {
+	if cb.Message == nil {
+		return
+	}
+	_, _ = bot.EditMessageReplyMarkup(ctx, &telego.EditMessageReplyMarkupParams{
+		ChatID:    tu.ID(cb.Message.GetChat().ID),
+		MessageID: cb.Message.GetMessageID(),
+	})
+}
+
+func handleConfirmCallback(bot *telego.Bot, ctx context.Context, cb *telego.CallbackQuery) {
+	chatID, messageID, inlineID, ok := parseConfirmData(cb.Data)
+	if !ok {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	var (
+		r     Rally
+		found bool
+		err   error
+	)
+	if inlineID != "" {
+		r, found, err = store.GetInline(inlineID)
+	} else {
+		r, found, err = store.Get(chatID, messageID)
+	}
+	if err != nil {
+		log.Printf("store get error: %v", err)
+	}
+	if !found {
+		dropConfirmButton(bot, ctx, cb)
+		sendCallback(bot, ctx, cb.ID, CONFIRM_NOTHING)
+		return
+	}
+	confirmed := confirmPending(&r, cb.From.ID)
+	if len(confirmed) == 0 {
+		if cb.Message != nil && cb.Message.GetChat().Type == telego.ChatTypePrivate {
+			dropConfirmButton(bot, ctx, cb)
+		}
+		sendCallback(bot, ctx, cb.ID, CONFIRM_NOTHING)
+		return
+	}
+	if err := store.Save(r); err != nil {
+		log.Printf("store save error: %v", err)
+	}
+	// An in-chat fallback post may be shared by several promoted users, so
+	// its button stays until nobody on the rally is waiting to confirm.
+	if cb.Message != nil && (cb.Message.GetChat().Type == telego.ChatTypePrivate || len(r.Pending) == 0) {
+		dropConfirmButton(bot, ctx, cb)
+	}
+	dropConfirmJobs(r, confirmed)
+	refreshRallyMessage(r)
+	sendCallback(bot, ctx, cb.ID, CONFIRM_DONE)
+}
+
+func expirePending(bot *telego.Bot, ctx context.Context, r Rally, j Job) {
+	i := findPending(r, j.UserID, j.N)
+	if i == -1 {
+		return
+	}
+	p := r.Pending[i]
+	if time.Now().Before(p.Until) {
+		armConfirmJobs(r)
+		return
+	}
+	before := cloneRally(r)
+	r.Pending = append(r.Pending[:i], r.Pending[i+1:]...)
+	dropped, ok := dropPending(&r, p)
+	if err := store.Save(r); err != nil {
+		log.Printf("store save error: %v", err)
+		return
+	}
+	armConfirmJobs(r)
+	refreshRallyMessage(r)
+	if ok {
+		text := fmt.Sprintf(NOTIFY_DROPPED, html.EscapeString(r.Name), html.EscapeString(r.Date))
+		notifyUsers(bot, ctx, &r, text, nil, []Entry{dropped}, 0)
+		notifyPromoted(bot, ctx, before, &r, 0)
+	}
+}
+
+// dropPending moves an unconfirmed entry to the waiting list once someone
+// else has taken its slot. The entry sits out the promotion so a role rally
+// cannot hand the slot straight back to it; if nobody else fits, it stays.
+func dropPending(r *Rally, p Pending) (Entry, bool) {
+	k := -1
+	for i, e := range r.SignedUp {
+		if e.UserID == p.UserID && e.N == p.N {
+			k = i
+			break
+		}
+	}
+	if k == -1 {
+		return Entry{}, false
+	}
+	e := r.SignedUp[k]
+	r.SignedUp = removeAtIndex(r.SignedUp, k)
+	n := len(r.SignedUp)
+	promoteWaiting(r)
+	if len(r.SignedUp) == n {
+		r.SignedUp = append(r.SignedUp[:k], append([]Entry{e}, r.SignedUp[k:]...)...)
+		return Entry{}, false
+	}
+	r.WaitingList = append(r.WaitingList, e)
+	return e, true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDropPending(t *testing.T) {
+	roles := []Role{{Name: "танк", Limit: 1}, {Name: "хил", Limit: 1}}
+	p := Pending{UserID: 1, Until: time.Now().Add(-time.Minute)}
+	tank := Entry{UserID: 1, Name: "tank", Role: "танк"}
+	healer := Entry{UserID: 2, Name: "healer", Role: "хил"}
+
+	r := Rally{Limit: 2, Roles: roles, ConfirmMinutes: 30,
+		SignedUp:    []Entry{tank, healer},
+		WaitingList: []Entry{{UserID: 3, Name: "healer2", Role: "хил"}},
+	}
+	if _, ok := dropPending(&r, p); ok {
+		t.Error("dropped a tank nobody waiting can replace")
+	}
+	if len(r.SignedUp) != 2 || r.SignedUp[0].UserID != 1 || len(r.WaitingList) != 1 || r.WaitingList[0].UserID != 3 {
+		t.Errorf("signed up = %+v, waiting = %+v", r.SignedUp, r.WaitingList)
+	}
+
+	r.WaitingList = append(r.WaitingList, Entry{UserID: 4, Name: "tank2", Role: "танк"})
+	e, ok := dropPending(&r, p)
+	if !ok || e.UserID != 1 {
+		t.Fatalf("dropPending = %+v, %v", e, ok)
+	}
+	if len(r.SignedUp) != 2 || r.SignedUp[1].UserID != 4 {
+		t.Errorf("signed up = %+v", r.SignedUp)
+	}
+	if len(r.WaitingList) != 2 || r.WaitingList[1].UserID != 1 {
+		t.Errorf("waiting = %+v", r.WaitingList)
+	}
+	if len(r.Pending) != 1 || r.Pending[0].UserID != 4 {
+		t.Errorf("pending = %+v", r.Pending)
+	}
+
+	r = Rally{Limit: 1, SignedUp: []Entry{{UserID: 1, Name: "vasya"}}}
+	if _, ok := dropPending(&r, p); ok || len(r.SignedUp) != 1 {
+		t.Errorf("dropped with an empty waiting list: %+v", r.SignedUp)
+	}
+	r.WaitingList = []Entry{{UserID: 2, Name: "petya"}}
+	if _, ok := dropPending(&r, p); !ok || r.SignedUp[0].UserID != 2 || r.WaitingList[0].UserID != 1 {
+		t.Errorf("signed up = %+v, waiting = %+v", r.SignedUp, r.WaitingList)
+	}
+}
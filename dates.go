@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+const (
+	DEFAULT_TIMEZONE = "Europe/Moscow"
+	DATE_FORMAT_MSG  = "Не удалось распознать дату. Примеры: 31.12.2025 21:00, 12.11, завтра 19:00, пт 20:00, через 2 часа"
+	DATE_PAST_MSG    = "Дата сбора уже прошла"
+)
+
+var (
+	errBadDate  = errors.New(DATE_FORMAT_MSG)
+	errPastDate = errors.New(DATE_PAST_MSG)
+	location    = time.UTC
+)
+
+var weekdays = map[string]time.Weekday{
+	"пн": time.Monday, "пон": time.Monday, "понедельник": time.Monday,
+	"вт": time.Tuesday, "вторник": time.Tuesday,
+	"ср": time.Wednesday, "среда": time.Wednesday, "среду": time.Wednesday,
+	"чт": time.Thursday, "чет": time.Thursday, "четверг": time.Thursday,
+	"пт": time.Friday, "пят": time.Friday, "пятница": time.Friday, "пятницу": time.Friday,
+	"сб": time.Saturday, "суб": time.Saturday, "суббота": time.Saturday, "субботу": time.Saturday,
+	"вс": time.Sunday, "вос": time.Sunday, "воскресенье": time.Sunday,
+}
+
+var relativeDays = map[string]int{
+	"сегодня":     0,
+	"завтра":      1,
+	"послезавтра": 2,
+}
+
+func loadLocation() (*time.Location, error) {
+	name := strings.TrimSpace(getenv("BOT_TIMEZONE", DEFAULT_TIMEZONE))
+	return time.LoadLocation(name)
+}
+
+func parseClock(s string) (hour, min int, ok bool) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	h, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || h < 0 || h > 23 || m < 0 || m > 59 || len(parts[1]) != 2 {
+		return 0, 0, false
+	}
+	return h, m, true
+}
+
+func parseDayMonth(s string, now time.Time) (time.Time, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return time.Time{}, false
+	}
+	day, err1 := strconv.Atoi(parts[0])
+	month, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, false
+	}
+	year := now.Year()
+	explicitYear := len(parts) == 3
+	if explicitYear {
+		y, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return time.Time{}, false
+		}
+		switch {
+		case len(parts[2]) == 2:
+			y += 2000
+		case len(parts[2]) != 4:
+			return time.Time{}, false
+		}
+		year = y
+	}
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, now.Location())
+	if t.Day() != day {
+		return time.Time{}, false
+	}
+	if !explicitYear && t.Before(startOfDay(now)) {
+		t = t.AddDate(1, 0, 0)
+	}
+	return t, true
+}
+
+func parseRelative(words []string, now time.Time) (time.Time, bool) {
+	amount := 1
+	if len(words) == 0 {
+		return time.Time{}, false
+	}
+	if n, err := strconv.Atoi(words[0]); err == nil {
+		if n <= 0 {
+			return time.Time{}, false
+		}
+		amount = n
+		words = words[1:]
+	}
+	if len(words) != 1 {
+		return time.Time{}, false
+	}
+	unit := words[0]
+	switch {
+	case unit == "полчаса":
+		return now.Add(30 * time.Minute).Truncate(time.Minute), amount == 1
+	case unit == "м" || strings.HasPrefix(unit, "мин"):
+		return now.Add(time.Duration(amount) * time.Minute).Truncate(time.Minute), true
+	case unit == "ч" || strings.HasPrefix(unit, "час"):
+		return now.Add(time.Duration(amount) * time.Hour).Truncate(time.Minute), true
+	case unit == "д" || unit == "день" || unit == "дня" || unit == "дней":
+		return now.AddDate(0, 0, amount).Truncate(time.Minute), true
+	case strings.HasPrefix(unit, "недел"):
+		return now.AddDate(0, 0, 7*amount).Truncate(time.Minute), true
+	}
+	return time.Time{}, false
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func parseDateSpec(text string, now time.Time) (start time.Time, allDay bool, err error) {
+	words := strings.Fields(strings.ToLower(strings.ReplaceAll(text, ",", " ")))
+	if len(words) > 0 && (words[0] == "в" || words[0] == "во") {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return time.Time{}, false, errBadDate
+	}
+	if words[0] == "через" {
+		t, ok := parseRelative(words[1:], now)
+		if !ok {
+			return time.Time{}, false, errBadDate
+		}
+		return t, false, nil
+	}
+
+	today := startOfDay(now)
+	var day time.Time
+	isWeekday := false
+	if h, m, ok := parseClock(words[0]); ok && len(words) == 1 {
+		return today.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute), false, nil
+	}
+	if offset, ok := relativeDays[words[0]]; ok {
+		day = today.AddDate(0, 0, offset)
+	} else if wd, ok := weekdays[words[0]]; ok {
+		day = today.AddDate(0, 0, (int(wd)-int(today.Weekday())+7)%7)
+		isWeekday = true
+	} else if t, ok := parseDayMonth(words[0], now); ok {
+		day = t
+	} else {
+		return time.Time{}, false, errBadDate
+	}
+	words = words[1:]
+	if len(words) > 0 && words[0] == "в" {
+		words = words[1:]
+	}
+	if len(words) == 0 {
+		return day, true, nil
+	}
+	h, m, ok := parseClock(words[0])
+	if !ok || len(words) > 1 {
+		return time.Time{}, false, errBadDate
+	}
+	start = day.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	if isWeekday && !start.After(now) {
+		start = start.AddDate(0, 0, 7)
+	}
+	return start, false, nil
+}
+
+func parseDate(text string, now time.Time) (start time.Time, allDay bool, err error) {
+	start, allDay, err = parseDateSpec(text, now)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if allDay && start.Before(startOfDay(now)) || !allDay && !start.After(now) {
+		return time.Time{}, false, errPastDate
+	}
+	return start, allDay, nil
+}
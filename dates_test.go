@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseDateSpec(t *testing.T) {
+	msk, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wednesday
+	now := time.Date(2025, 11, 5, 15, 30, 0, 0, msk)
+	at := func(y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, msk)
+	}
+	tests := []struct {
+		in     string
+		want   time.Time
+		allDay bool
+	}{
+		{"31.12.2025 21:00", at(2025, 12, 31, 21, 0), false},
+		{"31.12.25 21:00", at(2025, 12, 31, 21, 0), false},
+		{"12.11", at(2025, 11, 12, 0, 0), true},
+		{"12.11 в 18:30", at(2025, 11, 12, 18, 30), false},
+		{"01.02", at(2026, 2, 1, 0, 0), true},
+		{"сегодня 19:00", at(2025, 11, 5, 19, 0), false},
+		{"завтра 19:00", at(2025, 11, 6, 19, 0), false},
+		{"Завтра, 19:00", at(2025, 11, 6, 19, 0), false},
+		{"послезавтра", at(2025, 11, 7, 0, 0), true},
+		{"пт 20:00", at(2025, 11, 7, 20, 0), false},
+		{"в субботу", at(2025, 11, 8, 0, 0), true},
+		{"ср 15:00", at(2025, 11, 12, 15, 0), false},
+		{"ср 16:00", at(2025, 11, 5, 16, 0), false},
+		{"21:00", at(2025, 11, 5, 21, 0), false},
+		{"через 2 часа", at(2025, 11, 5, 17, 30), false},
+		{"через 30 минут", at(2025, 11, 5, 16, 0), false},
+		{"через час", at(2025, 11, 5, 16, 30), false},
+		{"через полчаса", at(2025, 11, 5, 16, 0), false},
+		{"через 3 дня", at(2025, 11, 8, 15, 30), false},
+		{"через неделю", at(2025, 11, 12, 15, 30), false},
+	}
+	for _, tt := range tests {
+		got, allDay, err := parseDateSpec(tt.in, now)
+		if err != nil {
+			t.Errorf("parseDateSpec(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) || allDay != tt.allDay {
+			t.Errorf("parseDateSpec(%q) = %v, %v; want %v, %v", tt.in, got, allDay, tt.want, tt.allDay)
+		}
+	}
+}
+
+func TestParseDateSpecInvalid(t *testing.T) {
+	now := time.Date(2025, 11, 5, 15, 30, 0, 0, time.UTC)
+	for _, in := range []string{"", "когда-нибудь", "32.12", "31.02", "12.13", "31.12.202 21:00", "пт 25:00", "пт 20:0", "завтра 19:00 утром", "через", "через 0 часов", "через 2 попугая", "часа"} {
+		if _, _, err := parseDateSpec(in, now); !errors.Is(err, errBadDate) {
+			t.Errorf("parseDateSpec(%q) error = %v, want errBadDate", in, err)
+		}
+	}
+}
+
+func TestParseDatePast(t *testing.T) {
+	now := time.Date(2025, 11, 5, 15, 30, 0, 0, time.UTC)
+	for _, in := range []string{"31.12.2024 21:00", "сегодня 10:00", "15:30", "05.11.2025 12:00"} {
+		if _, _, err := parseDate(in, now); !errors.Is(err, errPastDate) {
+			t.Errorf("parseDate(%q) error = %v, want errPastDate", in, err)
+		}
+	}
+	for _, in := range []string{"сегодня", "05.11.2025", "через 2 часа", "пт 20:00"} {
+		if _, _, err := parseDate(in, now); err != nil {
+			t.Errorf("parseDate(%q) error: %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	DELETE_PREFIX    = "del:"
+	DELETE_USAGE     = "Ответьте командой /sudo delete на сообщение сбора"
+	DELETE_CONFIRM   = "Удалить сбор «%s» вместе с напоминаниями? Отменить это нельзя."
+	DELETE_FORBIDDEN = "Удалять сборы могут только администраторы"
+	DELETE_DONE      = "Сбор удалён"
+	DELETE_MISSING   = "Сбор уже удалён"
+)
+
+func deleteRally(bot *telego.Bot, ctx context.Context, r Rally) error {
+	if err := store.Delete(r); err != nil {
+		return err
+	}
+	for _, id := range append([]int{r.MessageID}, r.Linked...) {
+		err := bot.DeleteMessage(ctx, &telego.DeleteMessageParams{
+			ChatID:    tu.ID(r.ChatID),
+			MessageID: id,
+		})
+		if err != nil {
+			log.Printf("delete message error: %v", err)
+		}
+	}
+	return nil
+}
+
+func parseDeleteData(data string) (messageID int, confirmed bool, ok bool) {
+	rest := strings.TrimPrefix(data, DELETE_PREFIX)
+	id, answer, _ := strings.Cut(rest, ":")
+	messageID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, false, false
+	}
+	return messageID, answer == "yes", true
+}
+
+func handleSudoDelete(bot *telego.Bot, ctx context.Context, msg *telego.Message) {
+	reply := msg.ReplyToMessage
+	if reply == nil {
+		rejectCommand(bot, ctx, msg, DELETE_USAGE)
+		return
+	}
+	r, ok, err := store.Get(msg.Chat.ID, reply.MessageID)
+	if err != nil {
+		log.Printf("store get error: %v", err)
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+		return
+	}
+	if !ok {
+		rejectCommand(bot, ctx, msg, DELETE_USAGE)
+		return
+	}
+	data := DELETE_PREFIX + strconv.Itoa(r.MessageID)
+	_, err = bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID:          tu.ID(msg.Chat.ID),
+		MessageThreadID: msg.MessageThreadID,
+		Text:            fmt.Sprintf(DELETE_CONFIRM, html.EscapeString(r.Name)),
+		ParseMode:       "HTML",
+		ReplyParameters: &telego.ReplyParameters{
+			MessageID:                r.MessageID,
+			AllowSendingWithoutReply: true,
+		},
+		ReplyMarkup: tu.InlineKeyboard(tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🗑 Удалить").WithCallbackData(data+":yes").WithStyle("danger"),
+			tu.InlineKeyboardButton("Оставить").WithCallbackData(data+":no"),
+		)),
+	})
+	if err != nil {
+		log.Printf("send error: %v", err)
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+	}
+}
+
+func handleDeleteCallback(bot *telego.Bot, ctx context.Context, cb *telego.CallbackQuery) {
+	messageID, confirmed, ok := parseDeleteData(cb.Data)
+	if !ok || cb.Message == nil {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	chatID := cb.Message.GetChat().ID
+	if !isAdmin(bot, ctx, chatID, &cb.From) {
+		sendCallback(bot, ctx, cb.ID, DELETE_FORBIDDEN)
+		return
+	}
+	dialog := &telego.DeleteMessageParams{
+		ChatID:    tu.ID(chatID),
+		MessageID: cb.Message.GetMessageID(),
+	}
+	if !confirmed {
+		_ = bot.DeleteMessage(ctx, dialog)
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+
+	r, ok, err := store.Get(chatID, messageID)
+	if err != nil {
+		log.Printf("store get error: %v", err)
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	if !ok {
+		_ = bot.DeleteMessage(ctx, dialog)
+		sendCallback(bot, ctx, cb.ID, DELETE_MISSING)
+		return
+	}
+	if err := deleteRally(bot, ctx, r); err != nil {
+		log.Printf("delete rally error: %v", err)
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	_ = bot.DeleteMessage(ctx, dialog)
+	sendCallback(bot, ctx, cb.ID, DELETE_DONE)
+}
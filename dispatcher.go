@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mymmrac/telego"
+)
+
+type dispatcher struct {
+	mu     sync.Mutex
+	queues map[string][]func()
+	wg     sync.WaitGroup
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{queues: make(map[string][]func())}
+}
+
+func rallyLockKey(chatID int64, messageID int) string {
+	return "rally:" + rallyKey(chatID, messageID)
+}
+
+func inlineLockKey(inlineMessageID string) string {
+	return "rally:" + inlineRallyKey(inlineMessageID)
+}
+
+func updateKey(u telego.Update) string {
+	switch {
+	case u.CallbackQuery != nil:
+		if strings.HasPrefix(u.CallbackQuery.Data, WIZARD_PREFIX) {
+			return "chat:" + strconv.FormatInt(u.CallbackQuery.From.ID, 10)
+		}
+		if strings.HasPrefix(u.CallbackQuery.Data, DELETE_PREFIX) && u.CallbackQuery.Message != nil {
+			if messageID, _, ok := parseDeleteData(u.CallbackQuery.Data); ok {
+				return rallyLockKey(u.CallbackQuery.Message.GetChat().ID, messageID)
+			}
+		}
+		if strings.HasPrefix(u.CallbackQuery.Data, CONFIRM_PREFIX) {
+			if key, ok := confirmLockKey(u.CallbackQuery.Data); ok {
+				return key
+			}
+		}
+		if strings.HasPrefix(u.CallbackQuery.Data, FRIEND_PREFIX) && u.CallbackQuery.Message != nil {
+			if messageID, _, _, ok := parseFriendData(u.CallbackQuery.Data); ok {
+				return rallyLockKey(u.CallbackQuery.Message.GetChat().ID, messageID)
+			}
+		}
+		if strings.HasPrefix(u.CallbackQuery.Data, SETTINGS_PREFIX) && u.CallbackQuery.Message != nil {
+			return "chat:" + strconv.FormatInt(u.CallbackQuery.Message.GetChat().ID, 10)
+		}
+		if u.CallbackQuery.InlineMessageID != "" {
+			return inlineLockKey(u.CallbackQuery.InlineMessageID)
+		}
+		if u.CallbackQuery.Message != nil {
+			return rallyLockKey(u.CallbackQuery.Message.GetChat().ID, u.CallbackQuery.Message.GetMessageID())
+		}
+		return "callback:" + u.CallbackQuery.ID
+	case u.ChosenInlineResult != nil:
+		return inlineLockKey(u.ChosenInlineResult.InlineMessageID)
+	case u.InlineQuery != nil:
+		return "inline_query:" + u.InlineQuery.ID
+	case u.Message != nil:
+		if key, ok := friendLockKey(u.Message); ok {
+			return key
+		}
+		if reply := u.Message.ReplyToMessage; reply != nil && (strings.HasPrefix(u.Message.Text, "/edit") || strings.HasPrefix(u.Message.Text, "/sudo delete")) {
+			return rallyLockKey(u.Message.Chat.ID, reply.MessageID)
+		}
+		return "chat:" + strconv.FormatInt(u.Message.Chat.ID, 10)
+	}
+	return "update:" + strconv.Itoa(u.UpdateID)
+}
+
+func (d *dispatcher) Dispatch(bot *telego.Bot, ctx context.Context, u telego.Update) {
+	d.Do(updateKey(u), func() {
+		switch {
+		case u.Message != nil:
+			handleMessage(bot, ctx, u.Message)
+		case u.InlineQuery != nil:
+			handleInlineQuery(bot, ctx, u.InlineQuery)
+		case u.ChosenInlineResult != nil:
+			handleChosenInlineResult(bot, ctx, u.ChosenInlineResult)
+		case u.CallbackQuery != nil && strings.HasPrefix(u.CallbackQuery.Data, WIZARD_PREFIX):
+			handleWizardCallback(bot, ctx, u.CallbackQuery)
+		case u.CallbackQuery != nil && strings.HasPrefix(u.CallbackQuery.Data, SETTINGS_PREFIX):
+			handleSettingsCallback(bot, ctx, u.CallbackQuery)
+		case u.CallbackQuery != nil && strings.HasPrefix(u.CallbackQuery.Data, CONFIRM_PREFIX):
+			handleConfirmCallback(bot, ctx, u.CallbackQuery)
+		case u.CallbackQuery != nil && strings.HasPrefix(u.CallbackQuery.Data, FRIEND_PREFIX):
+			handleFriendCallback(bot, ctx, u.CallbackQuery)
+		case u.CallbackQuery != nil && strings.HasPrefix(u.CallbackQuery.Data, DELETE_PREFIX):
+			handleDeleteCallback(bot, ctx, u.CallbackQuery)
+		case u.CallbackQuery != nil:
+			handleCallback(bot, ctx, u.CallbackQuery)
+		}
+	})
+}
+
+func (d *dispatcher) Do(key string, fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, running := d.queues[key]
+	d.queues[key] = append(q, fn)
+	if !running {
+		d.wg.Add(1)
+		go d.drain(key)
+	}
+}
+
+func (d *dispatcher) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *dispatcher) drain(key string) {
+	defer d.wg.Done()
+	for {
+		d.mu.Lock()
+		q := d.queues[key]
+		if len(q) == 0 {
+			delete(d.queues, key)
+			d.mu.Unlock()
+			return
+		}
+		fn := q[0]
+		d.queues[key] = q[1:]
+		d.mu.Unlock()
+		d.run(key, fn)
+	}
+}
+
+func (d *dispatcher) run(key string, fn func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic while handling %s: %v", key, err)
+		}
+	}()
+	fn()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+const (
+	EDIT_USAGE     = "Ответьте на сообщение сбора: /edit name <название> | /edit date <дата> | /edit limit <лимит>"
+	EDIT_FORBIDDEN = "Изменять сбор может только инициатор или администратор"
+	EDIT_FINISHED  = "Сбор уже завершён"
+)
+
+func setLimit(r *Rally, limit int) {
+	r.Limit = limit
+	if len(r.SignedUp) > limit {
+		overflow := append([]Entry(nil), r.SignedUp[limit:]...)
+		r.SignedUp = r.SignedUp[:limit]
+		r.WaitingList = append(overflow, r.WaitingList...)
+	}
+	promoteWaiting(r)
+}
+
+func handleEdit(bot *telego.Bot, ctx context.Context, msg *telego.Message, text string) {
+	fields := strings.Fields(text)
+	if msg.ReplyToMessage == nil || msg.From == nil || len(fields) < 3 {
+		rejectCommand(bot, ctx, msg, EDIT_USAGE)
+		return
+	}
+	rally, err := loadRally(msg.ReplyToMessage)
+	if err != nil {
+		rejectCommand(bot, ctx, msg, EDIT_USAGE)
+		return
+	}
+	if rally.InitiatorID != msg.From.ID && !isAdmin(bot, ctx, msg.Chat.ID, msg.From) {
+		rejectCommand(bot, ctx, msg, EDIT_FORBIDDEN)
+		return
+	}
+	if rally.Status == STATUS_FINISHED {
+		rejectCommand(bot, ctx, msg, EDIT_FINISHED)
+		return
+	}
+
+	before := cloneRally(rally)
+	value := strings.TrimSpace(strings.Join(fields[2:], " "))
+	switch fields[1] {
+	case "name", "название":
+		rally.Name = value
+	case "limit", "лимит":
+		if len(rally.Roles) > 0 {
+			rejectCommand(bot, ctx, msg, ROLES_LIMIT_MSG)
+			return
+		}
+		limit, err := strconv.Atoi(value)
+		if s := settingsFor(rally.ChatID); err != nil || !s.validLimit(limit) {
+			rejectCommand(bot, ctx, msg, s.limitRangeMsg())
+			return
+		}
+		if limit < rally.Min {
+			rejectCommand(bot, ctx, msg, MIN_RANGE_MSG)
+			return
+		}
+		setLimit(&rally, limit)
+	case "date", "дата":
+		if err := setRallyDate(&rally, value, time.Now().In(location)); err != nil {
+			rejectCommand(bot, ctx, msg, err.Error())
+			return
+		}
+		if rally.Status == STATUS_CLOSED && (rally.Deadline.IsZero() || rally.Deadline.After(time.Now())) {
+			rally.Status = STATUS_OPEN
+		}
+		armRallyJobs(rally)
+	default:
+		rejectCommand(bot, ctx, msg, EDIT_USAGE)
+		return
+	}
+
+	rally.SignedUp = filterBanned(rally.ChatID, rally.SignedUp)
+	rally.WaitingList = filterBanned(rally.ChatID, rally.WaitingList)
+	rally.PenciledIn = filterBanned(rally.ChatID, rally.PenciledIn)
+	reached := rally.Status != STATUS_CANCELLED && updateMinReached(&rally)
+	if err := store.Save(rally); err != nil {
+		log.Printf("store save error: %v", err)
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+		return
+	}
+	armConfirmJobs(rally)
+	refreshRallyMessage(rally)
+	setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👍")
+	if rally.Date != before.Date && rally.Status != STATUS_CANCELLED {
+		text := fmt.Sprintf(NOTIFY_DATE, html.EscapeString(rally.Name), html.EscapeString(rally.Date))
+		notifyUsers(bot, ctx, &rally, text, nil, participants(rally), msg.From.ID)
+	}
+	notifyPromoted(bot, ctx, before, &rally, msg.From.ID)
+	if reached {
+		announceMinReached(bot, ctx, &rally)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+	"github.com/mymmrac/telego/telegoapi"
+)
+
+var edits *editQueue
+
+type editQueue struct {
+	mu         sync.Mutex
+	bot        *telego.Bot
+	pending    map[string]*telego.EditMessageTextParams
+	order      []string
+	chatNext   map[string]time.Time
+	globalNext time.Time
+	inflight   int
+	wake       chan struct{}
+}
+
+func newEditQueue(bot *telego.Bot) *editQueue {
+	return &editQueue{
+		bot:      bot,
+		pending:  make(map[string]*telego.EditMessageTextParams),
+		chatNext: make(map[string]time.Time),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func editKey(p *telego.EditMessageTextParams) string {
+	if p.InlineMessageID != "" {
+		return inlineRallyKey(p.InlineMessageID)
+	}
+	return rallyKey(p.ChatID.ID, p.MessageID)
+}
+
+func editBucket(p *telego.EditMessageTextParams) string {
+	if p.InlineMessageID != "" {
+		return editKey(p)
+	}
+	return strconv.FormatInt(p.ChatID.ID, 10)
+}
+
+func (q *editQueue) Enqueue(p *telego.EditMessageTextParams) {
+	q.mu.Lock()
+	key := editKey(p)
+	if _, ok := q.pending[key]; !ok {
+		q.order = append(q.order, key)
+	}
+	q.pending[key] = p
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *editQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *editQueue) next(now time.Time) (*telego.EditMessageTextParams, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.order) == 0 {
+		return nil, -1
+	}
+	if now.Before(q.globalNext) {
+		return nil, q.globalNext.Sub(now)
+	}
+	wait := time.Duration(-1)
+	for i, key := range q.order {
+		p := q.pending[key]
+		ready := q.chatNext[editBucket(p)]
+		if now.Before(ready) {
+			if d := ready.Sub(now); wait < 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		q.order = append(q.order[:i:i], q.order[i+1:]...)
+		delete(q.pending, key)
+		q.chatNext[editBucket(p)] = now.Add(cfg.EditInterval)
+		q.globalNext = now.Add(cfg.GlobalEditInterval)
+		q.inflight++
+		return p, 0
+	}
+	return nil, wait
+}
+
+func (q *editQueue) retry(p *telego.EditMessageTextParams, after time.Duration) {
+	q.mu.Lock()
+	key := editKey(p)
+	q.chatNext[editBucket(p)] = time.Now().Add(after)
+	if _, ok := q.pending[key]; !ok {
+		q.pending[key] = p
+		q.order = append([]string{key}, q.order...)
+	}
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *editQueue) send(ctx context.Context, p *telego.EditMessageTextParams) {
+	_, err := q.bot.EditMessageText(ctx, p)
+	if err == nil {
+		return
+	}
+	if isNotModified(err) {
+		return
+	}
+	if wait, ok := retryAfter(err); ok {
+		log.Printf("edit throttled for %v in %s", wait, editBucket(p))
+		q.retry(p, wait)
+		return
+	}
+	log.Printf("edit error: %v", err)
+}
+
+func isNotModified(err error) bool {
+	var apiErr *telegoapi.Error
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == 400 &&
+		strings.Contains(apiErr.Description, "message is not modified")
+}
+
+func retryAfter(err error) (time.Duration, bool) {
+	var apiErr *telegoapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Parameters == nil || apiErr.Parameters.RetryAfter <= 0 {
+		return 0, false
+	}
+	return time.Duration(apiErr.Parameters.RetryAfter) * time.Second, true
+}
+
+func (q *editQueue) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		q.mu.Lock()
+		idle := len(q.order) == 0 && q.inflight == 0
+		left := len(q.order)
+		q.mu.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d edits left: %w", left, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *editQueue) Run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		p, wait := q.next(time.Now())
+		if p != nil {
+			q.send(ctx, p)
+			q.mu.Lock()
+			q.inflight--
+			q.mu.Unlock()
+			continue
+		}
+		var tick <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			tick = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-tick:
+		}
+	}
+}
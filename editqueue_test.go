@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mymmrac/telego/telegoapi"
+)
+
+func TestEditErrorClassification(t *testing.T) {
+	notModified := fmt.Errorf("telego: editMessageText: api: %w", &telegoapi.Error{
+		ErrorCode:   400,
+		Description: "Bad Request: message is not modified: specified new message content and reply markup are exactly the same",
+	})
+	throttled := fmt.Errorf("telego: editMessageText: api: %w", &telegoapi.Error{
+		ErrorCode:   429,
+		Description: "Too Many Requests: retry after 7",
+		Parameters:  &telegoapi.ResponseParameters{RetryAfter: 7},
+	})
+	other := errors.New("message is not modified, retry after 3")
+
+	if !isNotModified(notModified) || isNotModified(throttled) || isNotModified(other) {
+		t.Error("isNotModified misclassified an error")
+	}
+	if d, ok := retryAfter(throttled); !ok || d != 7*time.Second {
+		t.Errorf("retryAfter = %v, %v; want 7s", d, ok)
+	}
+	if _, ok := retryAfter(notModified); ok {
+		t.Error("retryAfter matched an error without parameters")
+	}
+	if _, ok := retryAfter(other); ok {
+		t.Error("retryAfter matched a plain error")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	FRIEND_PREFIX    = "fr:"
+	FRIEND_TIMEOUT   = 10 * time.Minute
+	FRIEND_NAME_MAX  = 64
+	FRIEND_PROMPT    = "%s, как зовут друга? Ответьте на это сообщение именем или @username"
+	FRIEND_CHOOSE    = "%s, кого убрать из сбора «%s»?"
+	FRIEND_NONE      = "У вас нет друзей в этом сборе"
+	FRIEND_NOT_YOURS = "Это не ваш список"
+	FRIEND_REMOVED   = "Друг убран"
+	FRIEND_BAD_NAME  = "Напишите имя друга текстом, до 64 символов"
+)
+
+type friendPrompt struct {
+	RallyMessageID int
+	UserID         int64
+	Created        time.Time
+}
+
+var (
+	friendPrompts = make(map[string]friendPrompt)
+	friendMu      sync.Mutex
+)
+
+func friendPromptFor(chatID int64, promptID int) (friendPrompt, bool) {
+	friendMu.Lock()
+	defer friendMu.Unlock()
+	p, ok := friendPrompts[rallyKey(chatID, promptID)]
+	return p, ok
+}
+
+func dropFriendPrompt(chatID int64, promptID int) {
+	friendMu.Lock()
+	delete(friendPrompts, rallyKey(chatID, promptID))
+	friendMu.Unlock()
+}
+
+func friendLockKey(msg *telego.Message) (string, bool) {
+	if msg.ReplyToMessage == nil {
+		return "", false
+	}
+	p, ok := friendPromptFor(msg.Chat.ID, msg.ReplyToMessage.MessageID)
+	if !ok {
+		return "", false
+	}
+	return rallyLockKey(msg.Chat.ID, p.RallyMessageID), true
+}
+
+func expireFriendPrompts(bot *telego.Bot, ctx context.Context, now time.Time) {
+	friendMu.Lock()
+	var expired []string
+	for key, p := range friendPrompts {
+		if now.Sub(p.Created) > FRIEND_TIMEOUT {
+			expired = append(expired, key)
+			delete(friendPrompts, key)
+		}
+	}
+	friendMu.Unlock()
+	for _, key := range expired {
+		chat, msg, _ := strings.Cut(key, ":")
+		chatID, _ := strconv.ParseInt(chat, 10, 64)
+		messageID, _ := strconv.Atoi(msg)
+		_ = bot.DeleteMessage(ctx, &telego.DeleteMessageParams{
+			ChatID:    tu.ID(chatID),
+			MessageID: messageID,
+		})
+	}
+}
+
+func nextFriendN(r Rally, userID int64) int {
+	return findMaxNumberAll(r.SignedUp, r.WaitingList, r.PenciledIn, userID) + 1
+}
+
+func userFriends(r Rally, userID int64) []Entry {
+	var res []Entry
+	for _, e := range participants(r) {
+		if e.UserID == userID && e.Friend != "" {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func removeFriend(r *Rally, userID int64, n int) bool {
+	removed := false
+	for _, list := range []*[]Entry{&r.SignedUp, &r.WaitingList, &r.PenciledIn} {
+		for i, e := range *list {
+			if e.UserID == userID && e.N == n && e.Friend != "" {
+				*list = removeAtIndex(*list, i)
+				removed = true
+				break
+			}
+		}
+		if removed {
+			break
+		}
+	}
+	if !removed {
+		return false
+	}
+	for _, list := range [][]Entry{r.SignedUp, r.WaitingList, r.PenciledIn} {
+		for i := range list {
+			if list[i].UserID == userID && list[i].N > n {
+				list[i].N--
+			}
+		}
+	}
+	// Confirm job IDs carry N, so the jobs of the removed and renumbered
+	// entries are dropped here and re-armed by the caller.
+	var stale []Pending
+	pending := r.Pending[:0]
+	for _, p := range r.Pending {
+		if p.UserID == userID && p.N >= n {
+			stale = append(stale, p)
+		}
+		if p.UserID == userID && p.N == n {
+			continue
+		}
+		if p.UserID == userID && p.N > n {
+			p.N--
+		}
+		pending = append(pending, p)
+	}
+	r.Pending = pending
+	dropConfirmJobs(*r, stale)
+	promoteWaiting(r)
+	return true
+}
+
+func startFriendPrompt(bot *telego.Bot, ctx context.Context, r Rally, u *telego.User) error {
+	sent, err := bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID:          tu.ID(r.ChatID),
+		MessageThreadID: r.ThreadID,
+		Text:            fmt.Sprintf(FRIEND_PROMPT, mention(u.ID, displayName(u))),
+		ParseMode:       "HTML",
+		ReplyMarkup: &telego.ForceReply{
+			ForceReply:            true,
+			InputFieldPlaceholder: "Имя друга",
+			Selective:             true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	friendMu.Lock()
+	friendPrompts[rallyKey(r.ChatID, sent.MessageID)] = friendPrompt{
+		RallyMessageID: r.MessageID,
+		UserID:         u.ID,
+		Created:        time.Now(),
+	}
+	friendMu.Unlock()
+	return nil
+}
+
+func friendFromMessage(msg *telego.Message) (string, int64, bool) {
+	for _, ent := range msg.Entities {
+		if ent.Type == "text_mention" && ent.User != nil && !ent.User.IsBot {
+			return displayName(ent.User), ent.User.ID, true
+		}
+	}
+	text := strings.TrimSpace(strings.SplitN(msg.Text, "\n", 2)[0])
+	if text == "" || strings.HasPrefix(text, "/") || len([]rune(text)) > FRIEND_NAME_MAX {
+		return "", 0, false
+	}
+	if strings.HasPrefix(text, "@") && !strings.Contains(text, " ") {
+		u, ok, err := users.LookupUsername(strings.ToLower(strings.TrimPrefix(text, "@")))
+		if err != nil {
+			log.Printf("lookup user error: %v", err)
+		}
+		if ok {
+			return "@" + u.Username, u.ID, true
+		}
+	}
+	return text, 0, true
+}
+
+func handleFriendReply(bot *telego.Bot, ctx context.Context, msg *telego.Message) bool {
+	if msg.ReplyToMessage == nil || msg.From == nil {
+		return false
+	}
+	p, ok := friendPromptFor(msg.Chat.ID, msg.ReplyToMessage.MessageID)
+	if !ok || p.UserID != msg.From.ID {
+		return false
+	}
+	name, friendID, ok := friendFromMessage(msg)
+	if !ok {
+		rejectCommand(bot, ctx, msg, FRIEND_BAD_NAME)
+		return true
+	}
+	dropFriendPrompt(msg.Chat.ID, msg.ReplyToMessage.MessageID)
+	_ = bot.DeleteMessage(ctx, &telego.DeleteMessageParams{
+		ChatID:    tu.ID(msg.Chat.ID),
+		MessageID: msg.ReplyToMessage.MessageID,
+	})
+
+	rally, found, err := store.Get(msg.Chat.ID, p.RallyMessageID)
+	if err != nil {
+		log.Printf("store get error: %v", err)
+	}
+	if !found || rally.Status != STATUS_OPEN || isBanned(rally.ChatID, msg.From.ID) {
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+		return true
+	}
+	maxFriends := settingsFor(rally.ChatID).MaxPlusFriends
+	n := nextFriendN(rally, msg.From.ID)
+	if n > maxFriends {
+		rejectCommand(bot, ctx, msg, fmt.Sprintf("Максимум %d друзей уже записано", maxFriends))
+		return true
+	}
+	e := userEntry(msg.From)
+	e.N, e.Friend, e.FriendID = n, name, friendID
+	placeEntry(&rally, e, "")
+	reached := updateMinReached(&rally)
+	if err := store.Save(rally); err != nil {
+		log.Printf("store save error: %v", err)
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+		return true
+	}
+	refreshRallyMessage(rally)
+	setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👍")
+	if reached {
+		announceMinReached(bot, ctx, &rally)
+	}
+	return true
+}
+
+func friendChooser(r Rally, u *telego.User, friends []Entry) *telego.SendMessageParams {
+	prefix := fmt.Sprintf("%s%d:%d:", FRIEND_PREFIX, r.MessageID, u.ID)
+	var rows [][]telego.InlineKeyboardButton
+	for _, f := range friends {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("Убрать "+f.Friend).WithCallbackData(prefix+strconv.Itoa(f.N)),
+		))
+	}
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton("Отмена").WithCallbackData(prefix+"x")))
+	return &telego.SendMessageParams{
+		ChatID:          tu.ID(r.ChatID),
+		MessageThreadID: r.ThreadID,
+		Text:            fmt.Sprintf(FRIEND_CHOOSE, mention(u.ID, displayName(u)), html.EscapeString(r.Name)),
+		ParseMode:       "HTML",
+		ReplyMarkup:     tu.InlineKeyboard(rows...),
+	}
+}
+
+func parseFriendData(data string) (messageID int, ownerID int64, n int, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(data, FRIEND_PREFIX), ":")
+	if len(parts) != 3 {
+		return 0, 0, 0, false
+	}
+	messageID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	ownerID, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	n, err = strconv.Atoi(parts[2])
+	if err != nil {
+		n = -1
+	}
+	return messageID, ownerID, n, true
+}
+
+func handleFriendCallback(bot *telego.Bot, ctx context.Context, cb *telego.CallbackQuery) {
+	messageID, ownerID, n, ok := parseFriendData(cb.Data)
+	if !ok || cb.Message == nil {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	if cb.From.ID != ownerID {
+		sendCallback(bot, ctx, cb.ID, FRIEND_NOT_YOURS)
+		return
+	}
+	chatID := cb.Message.GetChat().ID
+	_ = bot.DeleteMessage(ctx, &telego.DeleteMessageParams{
+		ChatID:    tu.ID(chatID),
+		MessageID: cb.Message.GetMessageID(),
+	})
+	if n < 0 {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	rally, found, err := store.Get(chatID, messageID)
+	if err != nil {
+		log.Printf("store get error: %v", err)
+	}
+	if !found || rally.Status != STATUS_OPEN {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	before := cloneRally(rally)
+	if !removeFriend(&rally, ownerID, n) {
+		sendCallback(bot, ctx, cb.ID, FRIEND_NONE)
+		return
+	}
+	if err := store.Save(rally); err != nil {
+		log.Printf("store save error: %v", err)
+	}
+	armConfirmJobs(rally)
+	refreshRallyMessage(rally)
+	sendCallback(bot, ctx, cb.ID, FRIEND_REMOVED)
+	notifyPromoted(bot, ctx, before, &rally, ownerID)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveFriendDropsItsPending(t *testing.T) {
+	fs, err := openFileStore(filepath.Join(t.TempDir(), "rallies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldJobs := jobs
+	defer func() { jobs = oldJobs }()
+	jobs = fs
+
+	now := time.Now()
+	r := Rally{
+		ChatID: 1, MessageID: 2, Status: STATUS_OPEN, Limit: 3, ConfirmMinutes: 30,
+		SignedUp: []Entry{
+			{UserID: 7, Name: "vasya"},
+			{UserID: 7, Name: "vasya", N: 1, Friend: "Петя"},
+			{UserID: 7, Name: "vasya", N: 2, Friend: "Коля"},
+		},
+		Pending: []Pending{
+			{UserID: 7, N: 1, Until: now.Add(10 * time.Minute)},
+			{UserID: 7, N: 2, Until: now.Add(20 * time.Minute)},
+		},
+	}
+	armConfirmJobs(r)
+
+	if !removeFriend(&r, 7, 1) {
+		t.Fatal("friend not removed")
+	}
+	if len(r.SignedUp) != 2 || r.SignedUp[1].Friend != "Коля" || r.SignedUp[1].N != 1 {
+		t.Fatalf("signed up = %+v", r.SignedUp)
+	}
+	if len(r.Pending) != 1 || r.Pending[0].N != 1 || !r.Pending[0].Until.Equal(now.Add(20*time.Minute)) {
+		t.Fatalf("pending = %+v", r.Pending)
+	}
+	if due, _ := jobs.DueJobs(now.Add(time.Hour)); len(due) != 0 {
+		t.Errorf("stale confirm jobs left: %+v", due)
+	}
+
+	armConfirmJobs(r)
+	due, _ := jobs.DueJobs(now.Add(time.Hour))
+	if len(due) != 1 || due[0].N != 1 || !due[0].At.Equal(r.Pending[0].Until) {
+		t.Errorf("re-armed jobs = %+v", due)
+	}
+}
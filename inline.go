@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/mymmrac/telego"
+)
+
+const (
+	INLINE_RESULT_ID    = "rally"
+	INLINE_HINT_ID      = "hint"
+	INLINE_USAGE        = "Напишите: название лимит дата [время]"
+	INLINE_NO_TEMPLATES = "Шаблоны доступны только в чате через /сбор @ключ"
+)
+
+func inlineRally(query string, u *telego.User) (Rally, error) {
+	cmd, err := parseCmd("/сбор " + query)
+	if err != nil {
+		return Rally{}, err
+	}
+	if cmd.Template != "" {
+		return Rally{}, fmt.Errorf(INLINE_NO_TEMPLATES)
+	}
+	return newRallyFromCmd(cmd, u, GLOBAL_BAN)
+}
+
+func inlineHint(text string) telego.InlineQueryResult {
+	return &telego.InlineQueryResultArticle{
+		Type:        telego.ResultTypeArticle,
+		ID:          INLINE_HINT_ID,
+		Title:       text,
+		Description: INLINE_USAGE,
+		InputMessageContent: &telego.InputTextMessageContent{
+			MessageText: "Создать сбор: @" + botUsername + " Башня 8 пт 21:00",
+		},
+	}
+}
+
+func handleInlineQuery(bot *telego.Bot, ctx context.Context, q *telego.InlineQuery) {
+	params := &telego.AnswerInlineQueryParams{
+		InlineQueryID: q.ID,
+		IsPersonal:    true,
+	}
+	r, err := inlineRally(q.Query, &q.From)
+	switch {
+	case isBanned(GLOBAL_BAN, q.From.ID):
+		params.Results = []telego.InlineQueryResult{}
+	case q.Query == "":
+		params.Results = []telego.InlineQueryResult{inlineHint(INLINE_USAGE)}
+	case err != nil:
+		params.Results = []telego.InlineQueryResult{inlineHint(err.Error())}
+	default:
+		params.Results = []telego.InlineQueryResult{&telego.InlineQueryResultArticle{
+			Type:        telego.ResultTypeArticle,
+			ID:          INLINE_RESULT_ID,
+			Title:       "🎉 " + r.Name,
+			Description: fmt.Sprintf("%s · лимит %d", r.Date, r.Limit),
+			InputMessageContent: &telego.InputTextMessageContent{
+				MessageText: formatRally(r),
+				ParseMode:   "HTML",
+			},
+			ReplyMarkup: buildKeyboard(r, r.Initiator),
+		}}
+	}
+	if err := bot.AnswerInlineQuery(ctx, params); err != nil {
+		log.Printf("answer inline query error: %v", err)
+	}
+}
+
+func handleChosenInlineResult(bot *telego.Bot, ctx context.Context, res *telego.ChosenInlineResult) {
+	if res.ResultID != INLINE_RESULT_ID || res.InlineMessageID == "" {
+		return
+	}
+	r, err := inlineRally(res.Query, &res.From)
+	if err != nil {
+		log.Printf("inline rally error: %v", err)
+		return
+	}
+	r.InlineMessageID = res.InlineMessageID
+	if err := store.Save(r); err != nil {
+		log.Printf("store save error: %v", err)
+		return
+	}
+	rememberUser(&res.From)
+	armRallyJobs(r)
+}
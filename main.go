@@ -1,55 +1,90 @@
 package main
 
 import (
-	"time"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
-    "bytes"
-    "encoding/json"
-    "fmt"
-    "net/http"
+	"time"
 
 	"github.com/mymmrac/telego"
 	tu "github.com/mymmrac/telego/telegoutil"
 )
 
 type Rally struct {
-	Name        string
-	Date        string
-	Limit       int
-	Initiator   string
-	SignedUp    []string
-	WaitingList []string
-	PenciledIn  []string
-	MessageID   int
-	ChatID      int64
+	Name         string
+	Date         string
+	Limit        int
+	Initiator    string
+	InitiatorID  int64
+	SignedUp     []Entry
+	WaitingList  []Entry
+	PenciledIn   []Entry
+	MessageID    int
+	ChatID       int64
+	ThreadID     int
+	Status       string
+	Start        time.Time
+	AllDay       bool
+	Deadline     time.Time
+	DeadlineText string
+	FinishedAt   time.Time
+	Description  string
+	Place        string
+	Min          int
+
+	InlineMessageID string    `json:",omitempty"`
+	Linked          []int     `json:",omitempty"`
+	ConfirmMinutes  int       `json:",omitempty"`
+	Pending         []Pending `json:",omitempty"`
+	Roles           []Role    `json:",omitempty"`
+	MinReached      bool      `json:",omitempty"`
+	CancelNote      string    `json:",omitempty"`
 }
 
 const (
-	ADMIN_USERNAME   = "@BulatHD"
 	CMD_USAGE        = "Используйте /сбор <название> <лимит> <дата> [время]"
-	LIMIT_MIN        = 2
-	LIMIT_MAX        = 30
-	LIMIT_RANGE_MSG  = "Лимит должен быть от 2 до 30"
-	MAX_PLUS_FRIENDS = 4
+	MIN_RANGE_MSG    = "Минимум должен быть от 1 до лимита"
+	STATUS_OPEN      = "open"
+	STATUS_CANCELLED = "cancelled"
+	STATUS_CLOSED    = "closed"
+	STATUS_FINISHED  = "finished"
+	CANCELLED_HEADER = "❌ СБОР ОТМЕНЁН ❌"
+	CLOSED_HEADER    = "🔒 ЗАПИСЬ ЗАКРЫТА 🔒"
+	FINISHED_HEADER  = "🏁 СБОР ЗАВЕРШЁН 🏁"
+	DEADLINE_MSG     = "Срок записи должен быть в будущем и не позже начала сбора"
+	DEFAULT_STORE    = "rallies.json"
+	SHUTDOWN_TIMEOUT = 20 * time.Second
 )
 
 var (
-	banList          []string
-	banMu            sync.RWMutex
 	textReplacements = make(map[string]string)
 	textMu           sync.RWMutex
-	deleteOnCancel   bool
-	deleteMu         sync.RWMutex
-	lastEditTime 	 time.Time
+	store            RallyStore
+	users            UserDirectory
+	chats            ChatDirectory
+	botUsername      string
+	botID            int64
+	errNotRally      = errors.New("message is not a rally")
 )
 
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 func displayName(u *telego.User) string {
 	if u == nil {
 		return ""
@@ -62,92 +97,9 @@ func displayName(u *telego.User) string {
 	return strings.TrimSpace(last + " " + first)
 }
 
-func isAdmin(user string) bool {
-	return user == ADMIN_USERNAME
-}
-
-func isBanned(user string) bool {
-	banMu.RLock()
-	defer banMu.RUnlock()
-	for _, u := range banList {
-		if u == user {
-			return true
-		}
-	}
-	return false
-}
-
-func addBan(user string) {
-	banMu.Lock()
-	defer banMu.Unlock()
-	for _, u := range banList {
-		if u == user {
-			return
-		}
-	}
-	banList = append(banList, user)
-}
-
-func removeBan(user string) {
-	banMu.Lock()
-	defer banMu.Unlock()
-	res := make([]string, 0, len(banList))
-	for _, u := range banList {
-		if u != user {
-			res = append(res, u)
-		}
-	}
-	banList = res
-}
-
-func clearBans() {
-	banMu.Lock()
-	defer banMu.Unlock()
-	banList = nil
-}
-
-func setDeleteOnCancel(v bool) {
-	deleteMu.Lock()
-	defer deleteMu.Unlock()
-	deleteOnCancel = v
-}
-
-func getDeleteOnCancel() bool {
-	deleteMu.RLock()
-	defer deleteMu.RUnlock()
-	return deleteOnCancel
-}
-
-func parseCmd(cmd string) (name string, limit int, date string, err error) {
-	words := strings.Fields(cmd)
-	if len(words) < 4 {
-		return "", 0, "", fmt.Errorf(CMD_USAGE)
-	}
-	limIdx := -1
-	for i := len(words) - 2; i >= 1; i-- {
-		if l, e := strconv.Atoi(words[i]); e == nil {
-			limIdx = i
-			limit = l
-			break
-		}
-	}
-	if limIdx == -1 || limIdx < 2 {
-		return "", 0, "", fmt.Errorf(CMD_USAGE)
-	}
-	name = strings.TrimSpace(strings.Join(words[1:limIdx], " "))
-	if name == "" {
-		return "", 0, "", fmt.Errorf(CMD_USAGE)
-	}
-	date = strings.Join(words[limIdx+1:], " ")
-	if strings.TrimSpace(date) == "" {
-		return "", 0, "", fmt.Errorf(CMD_USAGE)
-	}
-	return name, limit, date, nil
-}
-
 func cleanPrefix(line string) string {
 	line = strings.TrimSpace(line)
-	for _, prefix := range []string{"🎉", "📅", "🔢", "👤", "✍️", "✏️", "❌", "⏳"} {
+	for _, prefix := range []string{"🎉", "📅", "⏰", "📍", "📝", "🎯", "⏱", "🔢", "👤", "✍️", "✏️", "❌", "⏳"} {
 		if strings.HasPrefix(line, prefix) {
 			line = strings.TrimSpace(line[len(prefix):])
 		}
@@ -166,6 +118,22 @@ func parseRally(message string) (Rally, error) {
 			r.Name = strings.TrimSpace(line[len("Сбор:"):])
 		case strings.HasPrefix(line, "Дата:"):
 			r.Date = strings.TrimSpace(line[len("Дата:"):])
+		case strings.HasPrefix(line, "Запись до:"):
+			r.DeadlineText = strings.TrimSpace(line[len("Запись до:"):])
+		case strings.HasPrefix(line, "Место:"):
+			r.Place = strings.TrimSpace(line[len("Место:"):])
+		case strings.HasPrefix(line, "Минимум:"):
+			fields := strings.Fields(line[len("Минимум:"):])
+			if len(fields) > 0 {
+				r.Min, _ = strconv.Atoi(fields[0])
+			}
+			r.MinReached = strings.Contains(line, "набран")
+		case strings.HasPrefix(line, "Причина:"):
+			r.CancelNote = strings.TrimSpace(line[len("Причина:"):])
+		case strings.HasPrefix(line, "Подтверждение:"):
+			r.ConfirmMinutes, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(line[len("Подтверждение:"):]), " мин"))
+		case strings.HasPrefix(line, "Описание:"):
+			r.Description = strings.TrimSpace(line[len("Описание:"):])
 		case strings.HasPrefix(line, "Лимит:"):
 			limitStr := strings.TrimSpace(line[len("Лимит:"):])
 			limit := 0
@@ -190,21 +158,33 @@ func parseRally(message string) (Rally, error) {
 		default:
 			switch state {
 			case "signed", "waiting":
+				if role, ok := parseRoleHeader(line); ok && state == "signed" {
+					r.Roles = append(r.Roles, role)
+					continue
+				}
+				line, _, _ = strings.Cut(line, " — ждём подтверждения")
+				role := ""
+				if len(r.Roles) > 0 && state == "signed" {
+					role = r.Roles[len(r.Roles)-1].Name
+				} else if len(r.Roles) > 0 {
+					line, role = splitWaitingRole(line)
+				}
 				parts := strings.SplitN(line, " ", 2)
 				if len(parts) == 2 {
-					id := strings.TrimSpace(parts[1])
-					if id != "" {
+					e, ok := parseEntryText(r, parts[1])
+					e.Role = role
+					if ok {
 						if state == "signed" {
-							r.SignedUp = append(r.SignedUp, id)
+							r.SignedUp = append(r.SignedUp, e)
 						} else {
-							r.WaitingList = append(r.WaitingList, id)
+							r.WaitingList = append(r.WaitingList, e)
 						}
 					}
 				}
 			case "pencil":
-				id := strings.TrimSpace(line)
-				if id != "" {
-					r.PenciledIn = append(r.PenciledIn, id)
+				e, ok := parseEntryText(r, line)
+				if ok {
+					r.PenciledIn = append(r.PenciledIn, e)
 				}
 			}
 		}
@@ -218,73 +198,278 @@ func parseRally(message string) (Rally, error) {
 func formatRally(r Rally) string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf(
-		"<tg-emoji emoji-id=\"5310228579009699834\">🎉</tg-emoji> Сбор: %s\n<tg-emoji emoji-id=\"5433614043006903194\">📅</tg-emoji> Дата: %s\n<tg-emoji emoji-id=\"5373335654476294839\">🔢</tg-emoji> Лимит: %d\n<tg-emoji emoji-id=\"5373012449597335010\">👤</tg-emoji> Инициатор: %s\n\n<tg-emoji emoji-id=\"5470060791883374114\">✍️</tg-emoji> Записались:\n",
-		r.Name, r.Date, r.Limit, r.Initiator,
+		"%s Сбор: %s\n%s Дата: %s\n",
+		emoji("rally", "🎉"), html.EscapeString(r.Name), emoji("date", "📅"), html.EscapeString(r.Date),
+	))
+	if r.DeadlineText != "" {
+		sb.WriteString(fmt.Sprintf("⏰ Запись до: %s\n", html.EscapeString(r.DeadlineText)))
+	}
+	if r.Place != "" {
+		sb.WriteString(fmt.Sprintf("📍 Место: %s\n", html.EscapeString(r.Place)))
+	}
+	if r.Description != "" {
+		sb.WriteString(fmt.Sprintf("📝 Описание: %s\n", html.EscapeString(r.Description)))
+	}
+	if r.Min > 0 {
+		sb.WriteString(formatMinProgress(r))
+	}
+	if r.ConfirmMinutes > 0 {
+		sb.WriteString(fmt.Sprintf("⏱ Подтверждение: %d мин\n", r.ConfirmMinutes))
+	}
+	sb.WriteString(fmt.Sprintf(
+		"%s Лимит: %d\n%s Инициатор: %s\n\n%s Записались:\n",
+		emoji("limit", "🔢"), r.Limit, emoji("initiator", "👤"), mention(r.InitiatorID, r.Initiator), emoji("signup", "✍️"),
 	))
 	mainCount := len(r.SignedUp)
-	for i := 0; i < r.Limit; i++ {
-		if i < mainCount {
-			sb.WriteString(fmt.Sprintf("%d) %s\n", i+1, r.SignedUp[i]))
-		} else {
-			sb.WriteString(fmt.Sprintf("%d)\n", i+1))
+	if len(r.Roles) > 0 {
+		formatRoleSections(&sb, r)
+	} else {
+		for i := 0; i < r.Limit; i++ {
+			if i < mainCount {
+				sb.WriteString(fmt.Sprintf("%d) %s\n", i+1, formatSignedEntry(r, r.SignedUp[i])))
+			} else {
+				sb.WriteString(fmt.Sprintf("%d)\n", i+1))
+			}
 		}
 	}
 	if len(r.WaitingList) > 0 {
-		sb.WriteString("\n<tg-emoji emoji-id=\"5451646226975955576\">⏳</tg-emoji> Лист ожидания:\n")
+		sb.WriteString("\n" + emoji("waiting", "⏳") + " Лист ожидания:\n")
 		for i, user := range r.WaitingList {
-			sb.WriteString(fmt.Sprintf("%d) %s\n", r.Limit+i+1, user))
+			line := formatEntry(user)
+			if len(r.Roles) > 0 {
+				line += " — " + html.EscapeString(roleLabel(user.Role))
+			}
+			sb.WriteString(fmt.Sprintf("%d) %s\n", r.Limit+i+1, line))
 		}
 	}
-	sb.WriteString("\n<tg-emoji emoji-id=\"5334673106202010226\">✏️</tg-emoji> Карандашом:\n")
+	sb.WriteString("\n" + emoji("pencil", "✏️") + " Карандашом:\n")
 	for _, user := range r.PenciledIn {
-		sb.WriteString(user + "\n")
+		sb.WriteString(formatEntry(user) + "\n")
 	}
 	return sb.String()
 }
 
+func formatSignedEntry(r Rally, e Entry) string {
+	line := formatEntry(e)
+	if until, ok := pendingUntil(r, e); ok {
+		line += " — ждём подтверждения до " + until.In(location).Format("15:04")
+	}
+	return line
+}
+
 func buildKeyboard(r Rally, userName string) *telego.InlineKeyboardMarkup {
-    return tu.InlineKeyboard(
-        tu.InlineKeyboardRow(
-            tu.InlineKeyboardButton("Записаться").
-                WithCallbackData("sign_up").
-                WithStyle("success").
-                WithIconCustomEmojiID("5470060791883374114"),
-            tu.InlineKeyboardButton("Карандашом").
-                WithCallbackData("sign_up_pencil").
-                WithStyle("primary").
-                WithIconCustomEmojiID("5334673106202010226"),
-        ),
-        tu.InlineKeyboardRow(
-            tu.InlineKeyboardButton("Отписаться").
-                WithCallbackData("unsign").
-                WithIconCustomEmojiID("5188365693803830912"),
-            tu.InlineKeyboardButton("Отменить").
-                WithCallbackData("cancel").
-                WithStyle("danger").
-                WithIconCustomEmojiID("5465665476971471368"),
-        ),
-    )
+	rows := roleButtons(r)
+	signRow := tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton("Записаться").
+			WithCallbackData("sign_up").
+			WithStyle("success").
+			WithIconCustomEmojiID(cfg.Emoji["signup"]),
+	)
+	if len(r.Roles) > 0 {
+		signRow = tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🎲 Любая роль").
+				WithCallbackData("sign_up:any").
+				WithStyle("success"),
+		)
+	}
+	if settingsFor(r.ChatID).PencilAllowed {
+		signRow = append(signRow, tu.InlineKeyboardButton("Карандашом").
+			WithCallbackData("sign_up_pencil").
+			WithStyle("primary").
+			WithIconCustomEmojiID(cfg.Emoji["pencil"]))
+	}
+	rows = append(rows, signRow)
+	if r.InlineMessageID == "" && r.ChatID != 0 && settingsFor(r.ChatID).MaxPlusFriends > 0 {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("➕ Друг").WithCallbackData("friend"),
+			tu.InlineKeyboardButton("➖ Друг").WithCallbackData("unfriend"),
+		))
+	}
+	if len(r.Pending) > 0 {
+		rows = append(rows, tu.InlineKeyboardRow(confirmButton("confirm")))
+	}
+	rows = append(rows, leaveRow())
+	return tu.InlineKeyboard(rows...)
 }
 
-func buildResumeKeyboard(r Rally, userName string) *telego.InlineKeyboardMarkup {
-	if userName != r.Initiator && !isAdmin(userName) {
-		return nil
+func leaveRow() []telego.InlineKeyboardButton {
+	return tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton("Отписаться").
+			WithCallbackData("unsign").
+			WithIconCustomEmojiID(cfg.Emoji["unsign"]),
+		tu.InlineKeyboardButton("Отменить").
+			WithCallbackData("cancel").
+			WithStyle("danger").
+			WithIconCustomEmojiID(cfg.Emoji["cancel"]),
+	)
+}
+
+func buildClosedKeyboard(r Rally) *telego.InlineKeyboardMarkup {
+	var rows [][]telego.InlineKeyboardButton
+	if len(r.Pending) > 0 {
+		rows = append(rows, tu.InlineKeyboardRow(confirmButton("confirm")))
 	}
+	return tu.InlineKeyboard(append(rows, leaveRow())...)
+}
+
+func buildResumeKeyboard(r Rally, userName string) *telego.InlineKeyboardMarkup {
 	return tu.InlineKeyboard(
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton("Возобновить").
 				WithCallbackData("resume").
 				WithStyle("primary").
-				WithIconCustomEmojiID("5264727218734524899"),
+				WithIconCustomEmojiID(cfg.Emoji["resume"]),
 		),
 	)
 }
 
 func formatCancelledRally(r Rally) string {
-	return "❌ СБОР ОТМЕНЁН ❌\n" + formatRally(r)
+	if r.CancelNote != "" {
+		return CANCELLED_HEADER + "\nПричина: " + html.EscapeString(r.CancelNote) + "\n" + formatRally(r)
+	}
+	return CANCELLED_HEADER + "\n" + formatRally(r)
+}
+
+func renderRally(r Rally) string {
+	switch r.Status {
+	case STATUS_CANCELLED:
+		return formatCancelledRally(r)
+	case STATUS_CLOSED:
+		return CLOSED_HEADER + "\n" + formatRally(r)
+	case STATUS_FINISHED:
+		return FINISHED_HEADER + "\n" + formatRally(r)
+	}
+	return formatRally(r)
+}
+
+var closedActions = map[string]bool{"confirm": true, "unsign": true, "cancel": true}
+
+func rallyMarkup(r Rally) *telego.InlineKeyboardMarkup {
+	switch r.Status {
+	case STATUS_CANCELLED:
+		return buildResumeKeyboard(r, r.Initiator)
+	case STATUS_CLOSED:
+		return buildClosedKeyboard(r)
+	case STATUS_FINISHED:
+		return nil
+	}
+	return buildKeyboard(r, r.Initiator)
+}
+
+func splitDeadline(date string) (string, string) {
+	words := strings.Fields(date)
+	for i := 0; i+1 < len(words); i++ {
+		if strings.ToLower(words[i]) == "запись" && strings.ToLower(words[i+1]) == "до" {
+			return strings.Join(words[:i], " "), strings.Join(words[i+2:], " ")
+		}
+	}
+	return date, ""
 }
 
-func applyTextReplacementsConsume(text *string) bool {
+func setRallyDate(r *Rally, text string, now time.Time) error {
+	date, deadlineText := splitDeadline(text)
+	start, allDay, err := parseDate(date, now)
+	if err != nil {
+		return err
+	}
+	next := Rally{Start: start, AllDay: allDay}
+	var deadline time.Time
+	if deadlineText != "" {
+		if deadline, err = parseDeadline(deadlineText, next, now); err != nil {
+			return err
+		}
+	}
+	r.Date, r.Start, r.AllDay = date, start, allDay
+	r.Deadline, r.DeadlineText = deadline, deadlineText
+	return nil
+}
+
+func parseDeadline(text string, r Rally, now time.Time) (time.Time, error) {
+	var deadline time.Time
+	if h, m, ok := parseClock(strings.TrimSpace(text)); ok {
+		deadline = startOfDay(r.Start).Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	} else {
+		t, _, err := parseDateSpec(text, now)
+		if err != nil {
+			return time.Time{}, err
+		}
+		deadline = t
+	}
+	if !deadline.After(now) || deadline.After(rallyEnd(r)) {
+		return time.Time{}, fmt.Errorf(DEADLINE_MSG)
+	}
+	return deadline, nil
+}
+
+func parseLegacyRally(msg *telego.Message) (Rally, error) {
+	text := msg.Text
+	status := STATUS_OPEN
+	lines := strings.Split(text, "\n")
+	if len(lines) > 1 && strings.TrimSpace(lines[0]) == CANCELLED_HEADER {
+		text = strings.Join(lines[1:], "\n")
+		status = STATUS_CANCELLED
+	}
+	r, err := parseRally(text)
+	if err != nil {
+		return Rally{}, err
+	}
+	r.ChatID = msg.Chat.ID
+	r.MessageID = msg.MessageID
+	r.ThreadID = msg.MessageThreadID
+	r.Status = status
+	// Relative dates like "завтра" are relative to when the rally was posted.
+	sent := time.Now()
+	if msg.Date != 0 {
+		sent = time.Unix(msg.Date, 0)
+	}
+	if start, allDay, err := parseDateSpec(r.Date, sent.In(location)); err == nil {
+		r.Start, r.AllDay = start, allDay
+	}
+	return r, nil
+}
+
+func loadCallbackRally(cb *telego.CallbackQuery) (Rally, error) {
+	if cb.InlineMessageID != "" {
+		r, ok, err := store.GetInline(cb.InlineMessageID)
+		if err != nil {
+			return Rally{}, err
+		}
+		if !ok {
+			return Rally{}, fmt.Errorf("unknown inline rally %s", cb.InlineMessageID)
+		}
+		return r, nil
+	}
+	if cb.Message == nil || cb.Message.Message() == nil {
+		return Rally{}, fmt.Errorf("callback without accessible message")
+	}
+	return loadRally(cb.Message.Message())
+}
+
+func loadRally(msg *telego.Message) (Rally, error) {
+	r, ok, err := store.Get(msg.Chat.ID, msg.MessageID)
+	if err != nil {
+		return Rally{}, err
+	}
+	if ok {
+		return r, nil
+	}
+	// Only the bot's own messages can be pre-upgrade rallies; anything else
+	// is text a user typed or pasted.
+	if msg.From == nil || msg.From.ID != botID {
+		return Rally{}, errNotRally
+	}
+	r, err = parseLegacyRally(msg)
+	if err != nil {
+		return Rally{}, err
+	}
+	if err := store.Save(r); err != nil {
+		return Rally{}, err
+	}
+	armRallyJobs(r)
+	return r, nil
+}
+
+func applyTextReplacementsConsume(r *Rally) bool {
 	textMu.Lock()
 	defer textMu.Unlock()
 	changed := false
@@ -292,8 +477,22 @@ func applyTextReplacementsConsume(text *string) bool {
 		if oldName == "" {
 			continue
 		}
-		if strings.Contains(*text, oldName) {
-			*text = strings.ReplaceAll(*text, oldName, newName)
+		hit := false
+		replace := func(s string) string {
+			if !strings.Contains(s, oldName) {
+				return s
+			}
+			hit = true
+			return strings.ReplaceAll(s, oldName, newName)
+		}
+		r.Name = replace(r.Name)
+		r.Initiator = replace(r.Initiator)
+		for _, list := range [][]Entry{r.SignedUp, r.WaitingList, r.PenciledIn} {
+			for i := range list {
+				list[i].Name = replace(list[i].Name)
+			}
+		}
+		if hit {
 			delete(textReplacements, oldName)
 			changed = true
 		}
@@ -328,19 +527,72 @@ func setReaction(bot *telego.Bot, ctx context.Context, chatID int64, msgID int,
 	}
 }
 
-func editIgnoreNotModified(bot *telego.Bot, ctx context.Context, editParams *telego.EditMessageTextParams) {
-    for {
-        now := time.Now()
-        if now.Sub(lastEditTime) >= 1100*time.Millisecond {
-            break
-        }
-        time.Sleep(100 * time.Millisecond)
-    }
+func refreshRallyMessage(r Rally) {
+	p := &telego.EditMessageTextParams{
+		Text:        renderRally(r),
+		ParseMode:   "HTML",
+		ReplyMarkup: rallyMarkup(r),
+	}
+	if r.InlineMessageID != "" {
+		p.InlineMessageID = r.InlineMessageID
+	} else {
+		p.ChatID = tu.ID(r.ChatID)
+		p.MessageID = r.MessageID
+	}
+	edits.Enqueue(p)
+}
+
+func newRallyFromCmd(cmd rallyCmd, u *telego.User, chatID int64) (Rally, error) {
+	if s := settingsFor(chatID); !s.validLimit(cmd.Limit) {
+		return Rally{}, errors.New(s.limitRangeMsg())
+	}
+	if cmd.Min < 0 || cmd.Min > cmd.Limit {
+		return Rally{}, fmt.Errorf(MIN_RANGE_MSG)
+	}
+	rally := Rally{
+		Name:           cmd.Name,
+		Limit:          cmd.Limit,
+		Description:    cmd.Description,
+		Place:          cmd.Place,
+		Min:            cmd.Min,
+		Roles:          cmd.Roles,
+		ConfirmMinutes: cmd.Confirm,
+		Initiator:      displayName(u),
+		InitiatorID:    u.ID,
+		Status:         STATUS_OPEN,
+	}
+	if err := setRallyDate(&rally, cmd.Date, time.Now().In(location)); err != nil {
+		return Rally{}, err
+	}
+	return rally, nil
+}
+
+func publishRally(bot *telego.Bot, ctx context.Context, rally Rally) (Rally, error) {
+	sent, err := bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID:          tu.ID(rally.ChatID),
+		Text:            formatRally(rally),
+		ParseMode:       "HTML",
+		MessageThreadID: rally.ThreadID,
+		ReplyMarkup:     buildKeyboard(rally, rally.Initiator),
+	})
+	if err != nil {
+		return Rally{}, err
+	}
+	rally.MessageID = sent.MessageID
+	if err := store.Save(rally); err != nil {
+		log.Printf("store save error: %v", err)
+	}
+	armRallyJobs(rally)
+	return rally, nil
+}
 
-    _, err := bot.EditMessageText(ctx, editParams)
-    if err == nil {
-        lastEditTime = time.Now()
-    }
+func rejectCommand(bot *telego.Bot, ctx context.Context, msg *telego.Message, text string) {
+	_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID:          tu.ID(msg.Chat.ID),
+		Text:            text,
+		MessageThreadID: msg.MessageThreadID,
+	})
+	setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
 }
 
 func sendSilentCallback(bot *telego.Bot, ctx context.Context, callbackID string) {
@@ -380,31 +632,28 @@ func parseUserInstance(entry string) (base string, n int, ok bool) {
 	return basePart, val, true
 }
 
-func findAllUserNumbers(signed, waiting, penciled []string, user string) []int {
+func findAllUserNumbers(signed, waiting, penciled []Entry, userID int64) []int {
 	var res []int
 	for _, e := range signed {
-		base, n, ok := parseUserInstance(e)
-		if ok && base == user {
-			res = append(res, n)
+		if e.UserID == userID {
+			res = append(res, e.N)
 		}
 	}
 	for _, e := range waiting {
-		base, n, ok := parseUserInstance(e)
-		if ok && base == user {
-			res = append(res, n)
+		if e.UserID == userID {
+			res = append(res, e.N)
 		}
 	}
 	for _, e := range penciled {
-		base, n, ok := parseUserInstance(e)
-		if ok && base == user {
-			res = append(res, n)
+		if e.UserID == userID {
+			res = append(res, e.N)
 		}
 	}
 	return res
 }
 
-func findMaxNumberAll(signed, waiting, penciled []string, user string) int {
-	nums := findAllUserNumbers(signed, waiting, penciled, user)
+func findMaxNumberAll(signed, waiting, penciled []Entry, userID int64) int {
+	nums := findAllUserNumbers(signed, waiting, penciled, userID)
 	maxN := 0
 	for _, n := range nums {
 		if n > maxN {
@@ -414,39 +663,36 @@ func findMaxNumberAll(signed, waiting, penciled []string, user string) int {
 	return maxN
 }
 
-func findMaxInstanceGlobal(signed, waiting, penciled []string, user string) (where string, idx int, n int, ok bool) {
+func findMaxInstanceGlobal(signed, waiting, penciled []Entry, userID int64) (where string, idx int, n int, ok bool) {
 	maxN := -1
 	where = ""
 	idx = -1
 	for i, e := range signed {
-		base, num, okParse := parseUserInstance(e)
-		if !okParse || base != user {
+		if e.UserID != userID {
 			continue
 		}
-		if num > maxN {
-			maxN = num
+		if e.N > maxN {
+			maxN = e.N
 			where = "signed"
 			idx = i
 		}
 	}
 	for i, e := range waiting {
-		base, num, okParse := parseUserInstance(e)
-		if !okParse || base != user {
+		if e.UserID != userID {
 			continue
 		}
-		if num > maxN {
-			maxN = num
+		if e.N > maxN {
+			maxN = e.N
 			where = "waiting"
 			idx = i
 		}
 	}
 	for i, e := range penciled {
-		base, num, okParse := parseUserInstance(e)
-		if !okParse || base != user {
+		if e.UserID != userID {
 			continue
 		}
-		if num > maxN {
-			maxN = num
+		if e.N > maxN {
+			maxN = e.N
 			where = "pencil"
 			idx = i
 		}
@@ -457,43 +703,88 @@ func findMaxInstanceGlobal(signed, waiting, penciled []string, user string) (whe
 	return where, idx, maxN, true
 }
 
-func addUserInstanceGlobal(target, signed, waiting, penciled []string, user string) []string {
-	nums := findAllUserNumbers(signed, waiting, penciled, user)
-	maxN := 0
+func newUserInstance(signed, waiting, penciled []Entry, user Entry, maxFriends int) (Entry, bool) {
+	nums := findAllUserNumbers(signed, waiting, penciled, user.UserID)
+	maxN, self := 0, false
 	for _, n := range nums {
 		if n > maxN {
 			maxN = n
 		}
+		if n == 0 {
+			self = true
+		}
 	}
-	if maxN >= MAX_PLUS_FRIENDS {
-		return target
+	if !self {
+		user.N = 0
+		return user, true
 	}
-	if maxN == 0 && len(nums) == 0 {
-		return append(target, user)
+	if maxN >= maxFriends {
+		return Entry{}, false
 	}
-	return append(target, fmt.Sprintf("%s +%d", user, maxN+1))
+	user.N = maxN + 1
+	return user, true
 }
 
-func removeAtIndex(list []string, idx int) []string {
+// signUp moves the user's earliest pencilled entry into the rally, or adds a
+// new instance when nothing is pencilled. It fails once the user is at
+// maxFriends.
+func signUp(r *Rally, user Entry, role string, maxFriends int) bool {
+	minIdx := -1
+	minN := -1
+	for i, e := range r.PenciledIn {
+		if e.UserID != user.UserID {
+			continue
+		}
+		if minN == -1 || e.N < minN {
+			minN = e.N
+			minIdx = i
+		}
+	}
+	if minIdx != -1 {
+		entry := r.PenciledIn[minIdx]
+		r.PenciledIn = removeAtIndex(r.PenciledIn, minIdx)
+		placeEntry(r, entry, role)
+		return true
+	}
+	entry, ok := newUserInstance(r.SignedUp, r.WaitingList, r.PenciledIn, user, maxFriends)
+	if !ok {
+		return false
+	}
+	placeEntry(r, entry, role)
+	return true
+}
+
+func removeAtIndex(list []Entry, idx int) []Entry {
 	if idx < 0 || idx >= len(list) {
 		return list
 	}
 	return append(list[:idx], list[idx+1:]...)
 }
 
-func unsignGlobal(r *Rally, user string) {
-	where, idx, _, ok := findMaxInstanceGlobal(r.SignedUp, r.WaitingList, r.PenciledIn, user)
+func promoteWaiting(r *Rally) {
+	prunePending(r)
+	now := time.Now()
+	if len(r.Roles) > 0 {
+		promoteRoles(r, func(e Entry) { markPending(r, e, now) })
+		return
+	}
+	for len(r.SignedUp) < r.Limit && len(r.WaitingList) > 0 {
+		firstWaiting := r.WaitingList[0]
+		r.WaitingList = r.WaitingList[1:]
+		r.SignedUp = append(r.SignedUp, firstWaiting)
+		markPending(r, firstWaiting, now)
+	}
+}
+
+func unsignGlobal(r *Rally, userID int64) {
+	where, idx, _, ok := findMaxInstanceGlobal(r.SignedUp, r.WaitingList, r.PenciledIn, userID)
 	if !ok {
 		return
 	}
 	switch where {
 	case "signed":
 		r.SignedUp = removeAtIndex(r.SignedUp, idx)
-		if len(r.WaitingList) > 0 {
-			firstWaiting := r.WaitingList[0]
-			r.WaitingList = r.WaitingList[1:]
-			r.SignedUp = append(r.SignedUp, firstWaiting)
-		}
+		promoteWaiting(r)
 	case "waiting":
 		r.WaitingList = removeAtIndex(r.WaitingList, idx)
 	case "pencil":
@@ -501,15 +792,10 @@ func unsignGlobal(r *Rally, user string) {
 	}
 }
 
-func filterBanned(list []string) []string {
-	res := make([]string, 0, len(list))
+func filterBanned(chatID int64, list []Entry) []Entry {
+	res := make([]Entry, 0, len(list))
 	for _, e := range list {
-		base, _, ok := parseUserInstance(e)
-		if !ok {
-			res = append(res, e)
-			continue
-		}
-		if isBanned(base) {
+		if e.UserID != 0 && isBanned(chatID, e.UserID) {
 			continue
 		}
 		res = append(res, e)
@@ -517,10 +803,7 @@ func filterBanned(list []string) []string {
 	return res
 }
 
-func handleSudoRn(text string, userName string) (oldName, newName string, ok bool) {
-	if !isAdmin(userName) {
-		return "", "", false
-	}
+func handleSudoRn(text string) (oldName, newName string, ok bool) {
 	cmdPart := strings.TrimSpace(strings.TrimPrefix(text, "/sudo"))
 	fields := strings.Fields(cmdPart)
 	if len(fields) < 2 || fields[0] != "rn" {
@@ -539,10 +822,14 @@ func handleSudoRn(text string, userName string) (oldName, newName string, ok boo
 	return oldName, newName, true
 }
 
-func handleSudoBanUnbanClearDelete(text, userName string) bool {
-	if !isAdmin(userName) {
-		return false
+func banScope(msg *telego.Message, args []string) (int64, []string, bool) {
+	if len(args) > 0 && args[0] == "global" {
+		return GLOBAL_BAN, args[1:], isGlobalAdmin(msg.From)
 	}
+	return msg.Chat.ID, args, true
+}
+
+func handleSudoBanUnbanClear(text string, msg *telego.Message) bool {
 	cmdPart := strings.TrimSpace(strings.TrimPrefix(text, "/sudo"))
 	fields := strings.Fields(cmdPart)
 	if len(fields) < 1 {
@@ -550,34 +837,50 @@ func handleSudoBanUnbanClearDelete(text, userName string) bool {
 	}
 	switch fields[0] {
 	case "ban":
-		if len(fields) < 2 {
+		scope, args, ok := banScope(msg, fields[1:])
+		if !ok {
+			return false
+		}
+		target, expires, reason, ok := parseBanArgs(args, msg.ReplyToMessage)
+		if !ok {
 			return false
 		}
-		target := strings.TrimSpace(fields[1])
-		if target == "" {
+		err := bans.AddBan(Ban{
+			UserID:   target,
+			ChatID:   scope,
+			Reason:   reason,
+			IssuedBy: msg.From.ID,
+			Created:  time.Now(),
+			Expires:  expires,
+		})
+		if err != nil {
+			log.Printf("add ban error: %v", err)
 			return false
 		}
-		addBan(target)
 		return true
 	case "unban":
-		if len(fields) < 2 {
+		scope, args, ok := banScope(msg, fields[1:])
+		if !ok {
+			return false
+		}
+		target, _, _, ok := parseBanArgs(args, msg.ReplyToMessage)
+		if !ok {
 			return false
 		}
-		target := strings.TrimSpace(fields[1])
-		if target == "" {
+		if err := bans.RemoveBan(scope, target); err != nil {
+			log.Printf("remove ban error: %v", err)
 			return false
 		}
-		removeBan(target)
 		return true
 	case "clear":
-		clearBans()
+		if err := bans.ClearBans(msg.Chat.ID); err != nil {
+			log.Printf("clear bans error: %v", err)
+			return false
+		}
 		textMu.Lock()
 		textReplacements = make(map[string]string)
 		textMu.Unlock()
 		return true
-	case "delete":
-		setDeleteOnCancel(true)
-		return true
 	default:
 		return false
 	}
@@ -585,274 +888,421 @@ func handleSudoBanUnbanClearDelete(text, userName string) bool {
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	os.Exit(run())
+}
 
+func run() int {
 	token := os.Getenv("TELEGRAM_APITOKEN")
 	if token == "" {
-		log.Panic("TELEGRAM_APITOKEN is empty")
+		log.Print("TELEGRAM_APITOKEN is empty")
+		return 1
+	}
+
+	var err error
+	cfg, err = loadConfig()
+	if err != nil {
+		log.Printf("config error: %v", err)
+		return 1
 	}
 
 	bot, err := telego.NewBot(token)
 	if err != nil {
-		log.Panic(err)
+		log.Printf("create bot error: %v", err)
+		return 1
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	recvCtx, stopReceiving := context.WithCancel(context.Background())
+	defer stopReceiving()
+	workCtx, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
 
-	me, err := bot.GetMe(ctx)
+	me, err := bot.GetMe(workCtx)
 	if err != nil {
-		log.Panic(err)
+		log.Printf("get me error: %v", err)
+		return 1
 	}
 	log.Printf("Bot authorized on account @%s", me.Username)
+	botUsername = me.Username
+	botID = me.ID
 
-	updates, err := bot.UpdatesViaLongPolling(
-    ctx,
-    &telego.GetUpdatesParams{
-        Timeout: 120,
-        Limit:   100,
-        Offset:  0,
-    },
-    telego.WithLongPollingRetryTimeout(10 * time.Second),
-)
+	if err := loadAdmins(); err != nil {
+		log.Printf("load admins error: %v", err)
+		return 1
+	}
+
+	location, err = loadLocation()
+	if err != nil {
+		log.Printf("load timezone error: %v", err)
+		return 1
+	}
+
+	fs, err := openFileStore(getenv("STORE_PATH", DEFAULT_STORE))
+	if err != nil {
+		log.Printf("open store error: %v", err)
+		return 1
+	}
+	store = fs
+	users = fs
+	chats = fs
+	bans = fs
+	recurrings = fs
+	templates = fs
+	chatSettings = fs
+	notifyPrefs = fs
+	jobs = fs
+
+	updates, err := receiveUpdates(recvCtx, bot)
+	if err != nil {
+		log.Printf("receive updates error: %v", err)
+		return 1
+	}
 
-	sigChan := make(chan os.Signal, 1)
+	sigChan := make(chan os.Signal, 2)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
+		sig := <-sigChan
+		log.Printf("Received %v, shutting down", sig)
+		stopReceiving()
 		<-sigChan
-		cancel()
+		log.Print("Received second signal, exiting immediately")
+		os.Exit(1)
+	}()
+
+	edits = newEditQueue(bot)
+	go edits.Run(workCtx)
+
+	disp := newDispatcher()
+	schedulerDone := make(chan struct{})
+	go func() {
+		runScheduler(bot, workCtx, recvCtx.Done(), disp)
+		close(schedulerDone)
 	}()
 
 	for update := range updates {
-		if update.Message != nil {
-			msg := update.Message
-			text := strings.TrimSpace(msg.Text)
-			chatID := msg.Chat.ID
-			threadID := msg.MessageThreadID
-			userName := displayName(msg.From)
-
-			if strings.HasPrefix(text, "/sudo") {
-				if oldName, newName, ok := handleSudoRn(text, userName); ok {
-					textMu.Lock()
-					textReplacements[oldName] = newName
-					textMu.Unlock()
-					setReaction(bot, ctx, chatID, msg.MessageID, "👍")
-					continue
-				}
-				if handleSudoBanUnbanClearDelete(text, userName) {
-					setReaction(bot, ctx, chatID, msg.MessageID, "👍")
-				} else {
-					setReaction(bot, ctx, chatID, msg.MessageID, "👎")
-				}
-				continue
-			}
+		disp.Dispatch(bot, workCtx, update)
+	}
 
-			if strings.HasPrefix(text, "/сбор") || strings.HasPrefix(text, "/party") {
-				if isBanned(userName) {
-					setReaction(bot, ctx, chatID, msg.MessageID, "👎")
-					continue
-				}
+	code := 0
+	if recvCtx.Err() == nil {
+		log.Print("update channel closed unexpectedly")
+		code = 1
+	}
+	stopReceiving()
+	<-schedulerDone
 
-				name, limit, date, err := parseCmd(text)
-				if err != nil {
-					_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
-						ChatID:          tu.ID(chatID),
-						Text:            err.Error(),
-						MessageThreadID: threadID,
-					})
-					setReaction(bot, ctx, chatID, msg.MessageID, "👎")
-					continue
-				}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := disp.Wait(shutdownCtx); err != nil {
+		log.Printf("drain updates error: %v", err)
+		code = 1
+	}
+	if err := edits.Flush(shutdownCtx); err != nil {
+		log.Printf("flush edits error: %v", err)
+		code = 1
+	}
+	stopWork()
+	if err := fs.Close(); err != nil {
+		log.Printf("store close error: %v", err)
+		code = 1
+	}
+	log.Print("Shutdown complete")
+	return code
+}
 
-				if limit < LIMIT_MIN || limit > LIMIT_MAX {
-					_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
-						ChatID:          tu.ID(chatID),
-						Text:            LIMIT_RANGE_MSG,
-						MessageThreadID: threadID,
-					})
-					setReaction(bot, ctx, chatID, msg.MessageID, "👎")
-					continue
-				}
+func handleMessage(bot *telego.Bot, ctx context.Context, msg *telego.Message) {
+	text := strings.TrimSpace(msg.Text)
+	chatID := msg.Chat.ID
+	threadID := msg.MessageThreadID
+	rememberUser(msg.From)
+	rememberChat(msg)
+	if msg.Chat.Type == telego.ChatTypePrivate {
+		markStarted(msg.From)
+	}
 
-				initiator := userName
-				rally := Rally{
-					Name:      name,
-					Date:      date,
-					Limit:     limit,
-					Initiator: initiator,
-					ChatID:    chatID,
-				}
+	if msg.Chat.Type == telego.ChatTypePrivate && handleWizardMessage(bot, ctx, msg) {
+		return
+	}
+	if handleFriendReply(bot, ctx, msg) {
+		return
+	}
 
-				_, err = bot.SendMessage(ctx, &telego.SendMessageParams{
-					ChatID:      tu.ID(chatID),
-					Text:        formatRally(rally),
-					ParseMode:	"HTML",
-					MessageThreadID: threadID,
-					ReplyMarkup: buildKeyboard(rally, rally.Initiator),
-				})
-				if err != nil {
-					log.Printf("send error: %v", err)
-					setReaction(bot, ctx, chatID, msg.MessageID, "👎")
-				} else {
-					setReaction(bot, ctx, chatID, msg.MessageID, "👍")
-				}
-				continue
+	if strings.HasPrefix(text, "/sudo") {
+		if !isAdmin(bot, ctx, chatID, msg.From) {
+			setReaction(bot, ctx, chatID, msg.MessageID, "👎")
+			return
+		}
+		if oldName, newName, ok := handleSudoRn(text); ok {
+			textMu.Lock()
+			textReplacements[oldName] = newName
+			textMu.Unlock()
+			setReaction(bot, ctx, chatID, msg.MessageID, "👍")
+			return
+		}
+		if fields := strings.Fields(text); len(fields) == 2 && fields[1] == "bans" {
+			list, err := bans.ListBans(chatID, time.Now())
+			if err != nil {
+				log.Printf("list bans error: %v", err)
+				setReaction(bot, ctx, chatID, msg.MessageID, "👎")
+				return
 			}
+			_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
+				ChatID:          tu.ID(chatID),
+				Text:            formatBans(list),
+				ParseMode:       "HTML",
+				MessageThreadID: threadID,
+			})
+			return
 		}
+		if fields := strings.Fields(text); len(fields) == 2 && fields[1] == "delete" {
+			handleSudoDelete(bot, ctx, msg)
+			return
+		}
+		if handleSudoBanUnbanClear(text, msg) {
+			setReaction(bot, ctx, chatID, msg.MessageID, "👍")
+		} else {
+			setReaction(bot, ctx, chatID, msg.MessageID, "👎")
+		}
+		return
+	}
 
-		if update.CallbackQuery != nil {
-			cb := update.CallbackQuery
+	if strings.HasPrefix(text, "/recurring") {
+		handleRecurring(bot, ctx, msg, text)
+		return
+	}
 
-			if cb.Message == nil {
-				sendSilentCallback(bot, ctx, cb.ID)
-				continue
-			}
+	if strings.HasPrefix(text, "/template") {
+		handleTemplate(bot, ctx, msg, text)
+		return
+	}
 
-			msg := cb.Message.Message()
-			if msg == nil {
-				sendSilentCallback(bot, ctx, cb.ID)
-				continue
-			}
+	if strings.HasPrefix(text, "/new") {
+		handleNew(bot, ctx, msg)
+		return
+	}
 
-			user := displayName(&cb.From)
-			if user == "" || isBanned(user) {
-				sendSilentCallback(bot, ctx, cb.ID)
-				continue
-			}
+	if strings.HasPrefix(text, "/start") && msg.Chat.Type == telego.ChatTypePrivate {
+		_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
+			ChatID: tu.ID(chatID),
+			Text:   START_MSG,
+		})
+		return
+	}
+
+	if strings.HasPrefix(text, "/settings") {
+		handleSettings(bot, ctx, msg, text)
+		return
+	}
 
-			msgText := msg.Text
-			_ = applyTextReplacementsConsume(&msgText)
+	if strings.HasPrefix(text, "/notify") {
+		handleNotify(bot, ctx, msg, text)
+		return
+	}
 
-			rally, err := parseRally(msgText)
-			if err != nil {
-				log.Printf("parse rally error: %v", err)
-				sendSilentCallback(bot, ctx, cb.ID)
-				continue
+	if strings.HasPrefix(text, "/edit") {
+		handleEdit(bot, ctx, msg, text)
+		return
+	}
+
+	if strings.HasPrefix(text, "/сбор") || strings.HasPrefix(text, "/party") {
+		if msg.From == nil || isBanned(chatID, msg.From.ID) {
+			setReaction(bot, ctx, chatID, msg.MessageID, "👎")
+			return
+		}
+
+		cmd, err := parseCmdDefaultLimit(text, settingsFor(chatID).DefaultLimit)
+		if err != nil {
+			rejectCommand(bot, ctx, msg, err.Error())
+			return
+		}
+		if cmd.Template != "" {
+			if err := applyTemplate(&cmd, chatID); err != nil {
+				rejectCommand(bot, ctx, msg, err.Error())
+				return
 			}
+		}
 
-			edited := false
-			var newText string
-			var newMarkup *telego.InlineKeyboardMarkup
-
-			switch cb.Data {
-			case "sign_up":
-				minIdx := -1
-				minN := -1
-				for i, e := range rally.PenciledIn {
-					base, n, ok := parseUserInstance(e)
-					if !ok || base != user {
-						continue
-					}
-					if minN == -1 || n < minN {
-						minN = n
-						minIdx = i
-					}
-				}
-				if minIdx != -1 {
-					entry := user
-					if minN != 0 {
-						entry = fmt.Sprintf("%s +%d", user, minN)
-					}
-					if len(rally.SignedUp) < rally.Limit {
-						rally.SignedUp = append(rally.SignedUp, entry)
-					} else {
-						rally.WaitingList = append(rally.WaitingList, entry)
-					}
-					rally.PenciledIn = removeAtIndex(rally.PenciledIn, minIdx)
-				} else {
-					currentMax := findMaxNumberAll(rally.SignedUp, rally.WaitingList, rally.PenciledIn, user)
-					if currentMax >= MAX_PLUS_FRIENDS {
-						sendCallback(bot, ctx, cb.ID, fmt.Sprintf("Максимум %d друзей уже записано", MAX_PLUS_FRIENDS))
-						break
-					}
-					if len(rally.SignedUp) < rally.Limit {
-						rally.SignedUp = addUserInstanceGlobal(rally.SignedUp, rally.SignedUp, rally.WaitingList, rally.PenciledIn, user)
-					} else {
-						rally.WaitingList = addUserInstanceGlobal(rally.WaitingList, rally.SignedUp, rally.WaitingList, rally.PenciledIn, user)
-					}
-				}
-				edited = true
+		rally, err := newRallyFromCmd(cmd, msg.From, chatID)
+		if err != nil {
+			rejectCommand(bot, ctx, msg, err.Error())
+			return
+		}
+		rally.ChatID, rally.ThreadID = chatID, threadID
 
-			case "unsign":
-				unsignGlobal(&rally, user)
-				edited = true
+		if _, err := publishRally(bot, ctx, rally); err != nil {
+			log.Printf("send error: %v", err)
+			setReaction(bot, ctx, chatID, msg.MessageID, "👎")
+			return
+		}
+		setReaction(bot, ctx, chatID, msg.MessageID, "👍")
+		return
+	}
+}
 
-			case "sign_up_pencil":
-				currentMax := findMaxNumberAll(rally.SignedUp, rally.WaitingList, rally.PenciledIn, user)
-				if currentMax >= MAX_PLUS_FRIENDS {
-					sendCallback(bot, ctx, cb.ID, fmt.Sprintf("Максимум %d друзей уже записано", MAX_PLUS_FRIENDS))
-					break
-				}
-				rally.PenciledIn = addUserInstanceGlobal(rally.PenciledIn, rally.SignedUp, rally.WaitingList, rally.PenciledIn, user)
-				edited = true
-
-			case "cancel":
-				if user == rally.Initiator || isAdmin(user) {
-					if getDeleteOnCancel() && isAdmin(user) {
-						setDeleteOnCancel(false)
-						_ = bot.DeleteMessage(ctx, &telego.DeleteMessageParams{
-							ChatID:    tu.ID(msg.Chat.ID),
-							MessageID: msg.MessageID,
-						})
-						sendCallback(bot, ctx, cb.ID, "Сообщение удалено")
-						continue
-					}
-					rally.SignedUp = filterBanned(rally.SignedUp)
-					rally.WaitingList = filterBanned(rally.WaitingList)
-					rally.PenciledIn = filterBanned(rally.PenciledIn)
-					newText = formatCancelledRally(rally)
-					newMarkup = buildResumeKeyboard(rally, user)
-					edited = true
-					sendCallback(bot, ctx, cb.ID, "Сбор отменён")
-				}
+func handleCallback(bot *telego.Bot, ctx context.Context, cb *telego.CallbackQuery) {
+	user := userEntry(&cb.From)
+	if user.Name == "" {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
 
-			case "resume":
-				if user == rally.Initiator || isAdmin(user) {
-					lines := strings.Split(msg.Text, "\n")
-					newText = msg.Text
-					if len(lines) > 1 && strings.TrimSpace(lines[0]) == "❌ СБОР ОТМЕНЁН ❌" {
-						newText = strings.Join(lines[1:], "\n")
-					}
-					_ = applyTextReplacementsConsume(&newText)
-					resumedRally, err := parseRally(newText)
-					if err != nil {
-						resumedRally = rally
-					}
-					resumedRally.SignedUp = filterBanned(resumedRally.SignedUp)
-					resumedRally.WaitingList = filterBanned(resumedRally.WaitingList)
-					resumedRally.PenciledIn = filterBanned(resumedRally.PenciledIn)
-					newText = formatRally(resumedRally)
-					newMarkup = buildKeyboard(resumedRally, resumedRally.Initiator)
-					edited = true
-					sendCallback(bot, ctx, cb.ID, "Сбор возобновлён")
-				}
-			}
+	rally, err := loadCallbackRally(cb)
+	if err != nil {
+		log.Printf("load rally error: %v", err)
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	if isBanned(rally.ChatID, user.UserID) {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	rememberUser(&cb.From)
 
-			if edited {
-				rally.SignedUp = filterBanned(rally.SignedUp)
-				rally.WaitingList = filterBanned(rally.WaitingList)
-				rally.PenciledIn = filterBanned(rally.PenciledIn)
+	replaced := applyTextReplacementsConsume(&rally)
+	if claimEntries(&rally, &cb.From) {
+		replaced = true
+	}
 
-				if newText == "" {
-					newText = formatRally(rally)
-				}
-				if newMarkup == nil {
-					newMarkup = buildKeyboard(rally, rally.Initiator)
-				}
+	if rally.Status == STATUS_CANCELLED && cb.Data != "resume" {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	if rally.Status == STATUS_FINISHED || rally.Status == STATUS_CLOSED && !closedActions[cb.Data] {
+		sendCallback(bot, ctx, cb.ID, "Запись закрыта")
+		return
+	}
 
-				if newText != msg.Text || newMarkup != nil {
-					editParams := &telego.EditMessageTextParams{
-						ChatID:      tu.ID(msg.Chat.ID),
-						MessageID:   msg.MessageID,
-						Text:        newText,
-						ParseMode:   "HTML",
-						ReplyMarkup: newMarkup,
-					}
-					editIgnoreNotModified(bot, ctx, editParams)
+	edited := false
+	before := cloneRally(rally)
+	notice := ""
+	reached := false
+	settings := settingsFor(rally.ChatID)
+	maxFriends := settings.MaxPlusFriends
+
+	action, arg, _ := strings.Cut(cb.Data, ":")
+	switch action {
+	case "sign_up":
+		role, ok := roleArg(rally, arg)
+		if !ok {
+			break
+		}
+		if !signUp(&rally, user, role, maxFriends) {
+			sendCallback(bot, ctx, cb.ID, fmt.Sprintf("Максимум %d друзей уже записано", maxFriends))
+			break
+		}
+		edited = true
+
+	case "unsign":
+		unsignGlobal(&rally, user.UserID)
+		edited = true
+
+	case "friend":
+		if rally.InlineMessageID != "" {
+			break
+		}
+		if nextFriendN(rally, user.UserID) > maxFriends {
+			sendCallback(bot, ctx, cb.ID, fmt.Sprintf("Максимум %d друзей уже записано", maxFriends))
+			break
+		}
+		if err := startFriendPrompt(bot, ctx, rally, &cb.From); err != nil {
+			log.Printf("send error: %v", err)
+		}
+
+	case "unfriend":
+		friends := userFriends(rally, user.UserID)
+		switch {
+		case len(friends) == 0:
+			sendCallback(bot, ctx, cb.ID, FRIEND_NONE)
+		case len(friends) == 1 || rally.InlineMessageID != "":
+			removeFriend(&rally, user.UserID, friends[len(friends)-1].N)
+			edited = true
+			sendCallback(bot, ctx, cb.ID, FRIEND_REMOVED)
+		default:
+			if _, err := bot.SendMessage(ctx, friendChooser(rally, &cb.From, friends)); err != nil {
+				log.Printf("send error: %v", err)
+			}
+		}
+
+	case "sign_up_pencil":
+		if !settings.PencilAllowed {
+			sendCallback(bot, ctx, cb.ID, PENCIL_DISABLED)
+			break
+		}
+		entry, ok := newUserInstance(rally.SignedUp, rally.WaitingList, rally.PenciledIn, user, maxFriends)
+		if !ok {
+			sendCallback(bot, ctx, cb.ID, fmt.Sprintf("Максимум %d друзей уже записано", maxFriends))
+			break
+		}
+		rally.PenciledIn = append(rally.PenciledIn, entry)
+		edited = true
+
+	case "cancel":
+		admin := isAdmin(bot, ctx, rally.ChatID, &cb.From)
+		if user.UserID == rally.InitiatorID || admin {
+			if settings.DeleteOnCancel && rally.InlineMessageID == "" {
+				// Notify through a copy so the in-chat fallback stays out of
+				// Linked and survives the delete below.
+				notified := cloneRally(rally)
+				notifyRally(bot, ctx, &notified, NOTIFY_CANCELLED, user.UserID)
+				if err := deleteRally(bot, ctx, rally); err != nil {
+					log.Printf("delete rally error: %v", err)
+					sendSilentCallback(bot, ctx, cb.ID)
+					return
 				}
+				sendCallback(bot, ctx, cb.ID, "Сообщение удалено")
+				return
 			}
+			rally.Status = STATUS_CANCELLED
+			cancelRallyJobs(rally)
+			edited = true
+			notice = NOTIFY_CANCELLED
+			sendCallback(bot, ctx, cb.ID, "Сбор отменён")
+		}
+
+	case "confirm":
+		confirmed := confirmPending(&rally, user.UserID)
+		if len(confirmed) == 0 {
+			sendCallback(bot, ctx, cb.ID, CONFIRM_NOTHING)
+			break
+		}
+		dropConfirmJobs(rally, confirmed)
+		edited = true
+		sendCallback(bot, ctx, cb.ID, CONFIRM_DONE)
+
+	case "resume":
+		if user.UserID == rally.InitiatorID || isAdmin(bot, ctx, rally.ChatID, &cb.From) {
+			rally.Status = STATUS_OPEN
+			rally.CancelNote = ""
+			armRallyJobs(rally)
+			edited = true
+			notice = NOTIFY_RESUMED
+			sendCallback(bot, ctx, cb.ID, "Сбор возобновлён")
+		}
+	}
 
-			sendSilentCallback(bot, ctx, cb.ID)
+	if edited || replaced {
+		rally.SignedUp = filterBanned(rally.ChatID, rally.SignedUp)
+		rally.WaitingList = filterBanned(rally.ChatID, rally.WaitingList)
+		rally.PenciledIn = filterBanned(rally.ChatID, rally.PenciledIn)
+		reached = rally.Status != STATUS_CANCELLED && updateMinReached(&rally)
+		if err := store.Save(rally); err != nil {
+			log.Printf("store save error: %v", err)
 		}
+		if rally.Status != STATUS_CANCELLED {
+			armConfirmJobs(rally)
+		}
+
+		refreshRallyMessage(rally)
 	}
-}
\ No newline at end of file
+
+	sendSilentCallback(bot, ctx, cb.ID)
+	if notice != "" {
+		notifyRally(bot, ctx, &rally, notice, user.UserID)
+	}
+	if edited {
+		notifyPromoted(bot, ctx, before, &rally, user.UserID)
+	}
+	if reached {
+		announceMinReached(bot, ctx, &rally)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+func TestParseLegacyRallyUsesSendTime(t *testing.T) {
+	cfg.Emoji = nil
+	sent := time.Date(2025, 10, 1, 12, 0, 0, 0, location)
+	tests := []struct {
+		date string
+		want time.Time
+	}{
+		{"завтра 20:00", time.Date(2025, 10, 2, 20, 0, 0, 0, location)},
+		{"через 2 часа", time.Date(2025, 10, 1, 14, 0, 0, 0, location)},
+		{"01.10", time.Date(2025, 10, 1, 0, 0, 0, 0, location)},
+	}
+	for _, tt := range tests {
+		text := formatRally(Rally{Name: "Башня", Date: tt.date, Limit: 4, Initiator: "vasya"})
+		r, err := parseLegacyRally(&telego.Message{
+			MessageID: 5,
+			Chat:      telego.Chat{ID: 1},
+			Date:      sent.Unix(),
+			Text:      stripTags(text),
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.date, err)
+		}
+		if !r.Start.Equal(tt.want) {
+			t.Errorf("%s: start = %v, want %v", tt.date, r.Start, tt.want)
+		}
+	}
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]+>`)
+
+// stripTags turns formatted HTML into the plain text Telegram hands back.
+func stripTags(s string) string {
+	return html.UnescapeString(htmlTag.ReplaceAllString(s, ""))
+}
+
+func TestLoadRallyLegacyOnlyFromBot(t *testing.T) {
+	fs, err := openFileStore(filepath.Join(t.TempDir(), "rallies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore, oldJobs, oldID := store, jobs, botID
+	defer func() { store, jobs, botID = oldStore, oldJobs, oldID }()
+	store, jobs, botID = fs, fs, 100
+
+	cfg.Emoji = nil
+	text := stripTags(formatRally(Rally{Name: "Башня", Date: "31.12.2099 21:00", Limit: 4, Initiator: "vasya"}))
+	pasted := &telego.Message{MessageID: 5, Chat: telego.Chat{ID: 1}, From: &telego.User{ID: 7}, Text: text}
+	if _, err := loadRally(pasted); !errors.Is(err, errNotRally) {
+		t.Errorf("user message: err = %v, want errNotRally", err)
+	}
+	if _, ok, _ := fs.Get(1, 5); ok {
+		t.Error("user message was saved as a rally")
+	}
+
+	posted := &telego.Message{MessageID: 6, Chat: telego.Chat{ID: 1}, From: &telego.User{ID: 100, IsBot: true}, Text: text}
+	r, err := loadRally(posted)
+	if err != nil || r.Name != "Башня" {
+		t.Fatalf("bot message: %+v, %v", r, err)
+	}
+	if _, ok, _ := fs.Get(1, 6); !ok {
+		t.Error("bot message was not migrated into the store")
+	}
+}
+
+func TestSignUpWithoutFriends(t *testing.T) {
+	r := Rally{Limit: 4}
+	vasya := Entry{UserID: 7, Name: "vasya"}
+	if !signUp(&r, vasya, "", 0) {
+		t.Fatal("first sign-up rejected with max_friends = 0")
+	}
+	if signUp(&r, vasya, "", 0) {
+		t.Error("second sign-up accepted with max_friends = 0")
+	}
+	if len(r.SignedUp) != 1 || r.SignedUp[0].N != 0 {
+		t.Errorf("signed up = %+v", r.SignedUp)
+	}
+
+	if _, ok := newUserInstance(nil, nil, nil, Entry{UserID: 8}, 0); !ok {
+		t.Error("first pencil rejected with max_friends = 0")
+	}
+}
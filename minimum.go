@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+const (
+	JOB_DECIDE         = "decide"
+	MIN_CANCEL_NOTE    = "Не набрался минимум участников"
+	MIN_REACHED_MSG    = "Сбор состоялся ✅ «%s» (%s): записалось %d при минимуме %d\n%s"
+	NOTIFY_MIN_REACHED = "Сбор состоялся ✅ «%s» (%s)"
+	NOTIFY_MIN_CANCEL  = "❌ Сбор «%s» (%s) отменён: не набрался минимум участников"
+)
+
+func decisionTime(r Rally) time.Time {
+	if r.Min <= 0 || r.Start.IsZero() {
+		return time.Time{}
+	}
+	return r.Start.Add(-cfg.MinDecision)
+}
+
+func formatMinProgress(r Rally) string {
+	count := len(r.SignedUp)
+	if count >= r.Min {
+		return fmt.Sprintf("🎯 Минимум: %d — набран ✅\n", r.Min)
+	}
+	line := fmt.Sprintf("🎯 Минимум: %d (есть %d, нужно ещё %d", r.Min, count, r.Min-count)
+	if at := decisionTime(r); at.After(time.Now()) {
+		line += ", решение " + at.In(location).Format("02.01 15:04")
+	}
+	return line + ")\n"
+}
+
+func updateMinReached(r *Rally) bool {
+	if r.Min <= 0 || r.MinReached || len(r.SignedUp) < r.Min {
+		return false
+	}
+	r.MinReached = true
+	return true
+}
+
+func announceMinReached(bot *telego.Bot, ctx context.Context, r *Rally) {
+	name, date := html.EscapeString(r.Name), html.EscapeString(r.Date)
+	if r.InlineMessageID != "" {
+		notifyUsers(bot, ctx, r, fmt.Sprintf(NOTIFY_MIN_REACHED, name, date), nil, r.SignedUp, 0)
+		return
+	}
+	postToRally(bot, ctx, r, fmt.Sprintf(MIN_REACHED_MSG, name, date, len(r.SignedUp), r.Min, mentionList(r.SignedUp)))
+}
+
+func decideRally(bot *telego.Bot, ctx context.Context, r Rally) {
+	if r.Min <= 0 || len(r.SignedUp) >= r.Min || !time.Now().Before(r.Start) {
+		return
+	}
+	r.Status = STATUS_CANCELLED
+	r.CancelNote = MIN_CANCEL_NOTE
+	if err := store.Save(r); err != nil {
+		log.Printf("store save error: %v", err)
+		return
+	}
+	cancelRallyJobs(r)
+	refreshRallyMessage(r)
+	notifyRally(bot, ctx, &r, NOTIFY_MIN_CANCEL, 0)
+}
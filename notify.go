@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	NOTIFY_USAGE      = "Используйте /notify, /notify on или /notify off"
+	NOTIFY_ON         = "🔔 Уведомления о ваших сборах включены. Выключить: /notify off"
+	NOTIFY_OFF        = "🔕 Уведомления о ваших сборах выключены. Включить: /notify on"
+	NOTIFY_START_HINT = "\nЧтобы получать их в личку, откройте @%s и нажмите «Старт», иначе я буду упоминать вас в чате."
+	NOTIFY_PROMOTED   = "🎉 Место освободилось: вы в основном составе сбора «%s» (%s)"
+	NOTIFY_CANCELLED  = "❌ Сбор «%s» (%s) отменён"
+	NOTIFY_RESUMED    = "🔄 Сбор «%s» (%s) снова в силе"
+	NOTIFY_DATE       = "📅 Сбор «%s» перенесён на %s"
+)
+
+type NotifyPrefs struct {
+	UserID   int64
+	Started  bool
+	Disabled bool
+}
+
+var notifyPrefs NotifyStore
+
+func loadNotify(userID int64) NotifyPrefs {
+	p, ok, err := notifyPrefs.GetNotify(userID)
+	if err != nil {
+		log.Printf("notify get error: %v", err)
+	}
+	if !ok {
+		p = NotifyPrefs{UserID: userID}
+	}
+	return p
+}
+
+func markStarted(u *telego.User) {
+	if u == nil || u.IsBot {
+		return
+	}
+	p := loadNotify(u.ID)
+	if p.Started {
+		return
+	}
+	p.Started = true
+	if err := notifyPrefs.SaveNotify(p); err != nil {
+		log.Printf("notify save error: %v", err)
+	}
+}
+
+func handleNotify(bot *telego.Bot, ctx context.Context, msg *telego.Message, text string) {
+	if msg.From == nil {
+		return
+	}
+	p := loadNotify(msg.From.ID)
+	fields := strings.Fields(text)
+	switch len(fields) {
+	case 1:
+		p.Disabled = !p.Disabled
+	case 2:
+		on, ok := parseSwitch(fields[1])
+		if !ok {
+			rejectCommand(bot, ctx, msg, NOTIFY_USAGE)
+			return
+		}
+		p.Disabled = !on
+	default:
+		rejectCommand(bot, ctx, msg, NOTIFY_USAGE)
+		return
+	}
+	if err := notifyPrefs.SaveNotify(p); err != nil {
+		log.Printf("notify save error: %v", err)
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+		return
+	}
+	reply := NOTIFY_ON
+	if p.Disabled {
+		reply = NOTIFY_OFF
+	} else if !p.Started {
+		reply += fmt.Sprintf(NOTIFY_START_HINT, botUsername)
+	}
+	_, err := bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID:          tu.ID(msg.Chat.ID),
+		MessageThreadID: msg.MessageThreadID,
+		Text:            reply,
+		ReplyParameters: &telego.ReplyParameters{
+			MessageID:                msg.MessageID,
+			AllowSendingWithoutReply: true,
+		},
+	})
+	if err != nil {
+		log.Printf("send error: %v", err)
+	}
+}
+
+func entryKey(e Entry) string {
+	if e.UserID != 0 {
+		return strconv.FormatInt(e.UserID, 10)
+	}
+	return e.Name
+}
+
+func participants(r Rally) []Entry {
+	var res []Entry
+	for _, list := range [][]Entry{r.SignedUp, r.WaitingList, r.PenciledIn} {
+		res = append(res, list...)
+	}
+	return res
+}
+
+func promotedEntries(before, after Rally) []Entry {
+	key := func(e Entry) string { return fmt.Sprintf("%s+%d", entryKey(e), e.N) }
+	wasSigned := make(map[string]bool)
+	for _, e := range before.SignedUp {
+		wasSigned[key(e)] = true
+	}
+	wasWaiting := make(map[string]bool)
+	for _, e := range before.WaitingList {
+		wasWaiting[key(e)] = true
+	}
+	var res []Entry
+	for _, e := range after.SignedUp {
+		if !wasSigned[key(e)] && wasWaiting[key(e)] {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func sendDM(bot *telego.Bot, ctx context.Context, userID int64, text string, markup *telego.InlineKeyboardMarkup) bool {
+	p := &telego.SendMessageParams{
+		ChatID:    tu.ID(userID),
+		Text:      text,
+		ParseMode: "HTML",
+	}
+	if markup != nil {
+		p.ReplyMarkup = markup
+	}
+	_, err := bot.SendMessage(ctx, p)
+	if err != nil {
+		log.Printf("notify dm %d error: %v", userID, err)
+		return false
+	}
+	return true
+}
+
+func notifyUsers(bot *telego.Bot, ctx context.Context, r *Rally, text string, markup *telego.InlineKeyboardMarkup, targets []Entry, actorID int64) {
+	seen := make(map[string]bool)
+	var fallback []Entry
+	for _, e := range targets {
+		if seen[entryKey(e)] || e.UserID != 0 && e.UserID == actorID {
+			continue
+		}
+		seen[entryKey(e)] = true
+		if e.UserID == 0 {
+			fallback = append(fallback, e)
+			continue
+		}
+		p := loadNotify(e.UserID)
+		if p.Disabled {
+			continue
+		}
+		if p.Started && sendDM(bot, ctx, e.UserID, text, markup) {
+			continue
+		}
+		fallback = append(fallback, e)
+	}
+	if len(fallback) > 0 && r.InlineMessageID == "" {
+		postToRally(bot, ctx, r, text+"\n"+mentionList(fallback))
+	}
+}
+
+func notifyRally(bot *telego.Bot, ctx context.Context, r *Rally, format string, actorID int64) {
+	text := fmt.Sprintf(format, html.EscapeString(r.Name), html.EscapeString(r.Date))
+	notifyUsers(bot, ctx, r, text, nil, participants(*r), actorID)
+}
+
+func notifyPromoted(bot *telego.Bot, ctx context.Context, before Rally, r *Rally, actorID int64) {
+	var plain, pending []Entry
+	until := time.Time{}
+	for _, e := range promotedEntries(before, *r) {
+		if t, ok := pendingUntil(*r, e); ok {
+			pending = append(pending, e)
+			until = t
+			continue
+		}
+		plain = append(plain, e)
+	}
+	name, date := html.EscapeString(r.Name), html.EscapeString(r.Date)
+	if len(plain) > 0 {
+		notifyUsers(bot, ctx, r, fmt.Sprintf(NOTIFY_PROMOTED, name, date), nil, plain, actorID)
+	}
+	if len(pending) > 0 {
+		text := fmt.Sprintf(NOTIFY_CONFIRM, name, date, until.In(location).Format("15:04"))
+		notifyUsers(bot, ctx, r, text, confirmMarkup(*r), pending, actorID)
+	}
+}
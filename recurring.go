@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	JOB_RECURRING   = "recurring"
+	RECURRING_LEAD  = 24 * time.Hour
+	RECURRING_USAGE = "Используйте:\n/recurring add <название> <лимит> каждый <день> <время> [за <N>ч]\n/recurring list\n/recurring pause|resume|delete <id>\n/recurring regulars <id> @user ..."
+	RECURRING_MSG   = "Расписание должно выглядеть как «каждый чт 20:00» или «каждую пятницу 21:00 за 48ч»"
+	RECURRING_404   = "Повторяющийся сбор не найден"
+)
+
+var weekdayShort = [...]string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"}
+
+type Recurring struct {
+	ID        string
+	ChatID    int64
+	ThreadID  int
+	Name      string
+	Limit     int
+	Weekday   time.Weekday
+	Hour      int
+	Minute    int
+	Lead      time.Duration
+	Regulars  []Entry
+	OwnerID   int64
+	OwnerName string
+	Paused    bool
+	NextAt    time.Time
+}
+
+var recurrings RecurringStore
+
+func parseSchedule(text string) (wd time.Weekday, hour, min int, lead time.Duration, err error) {
+	words := strings.Fields(strings.ToLower(strings.ReplaceAll(text, ",", " ")))
+	if len(words) > 0 && strings.HasPrefix(words[0], "кажд") {
+		words = words[1:]
+	}
+	if len(words) < 2 {
+		return 0, 0, 0, 0, fmt.Errorf(RECURRING_MSG)
+	}
+	wd, ok := weekdays[words[0]]
+	if !ok {
+		return 0, 0, 0, 0, fmt.Errorf(RECURRING_MSG)
+	}
+	hour, min, ok = parseClock(words[1])
+	if !ok {
+		return 0, 0, 0, 0, fmt.Errorf(RECURRING_MSG)
+	}
+	lead = RECURRING_LEAD
+	rest := strings.Join(words[2:], "")
+	if rest != "" {
+		hours, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(rest, "за"), "ч"), "h"))
+		if !strings.HasPrefix(rest, "за") || err != nil || hours <= 0 || hours > 24*7 {
+			return 0, 0, 0, 0, fmt.Errorf(RECURRING_MSG)
+		}
+		lead = time.Duration(hours) * time.Hour
+	}
+	return wd, hour, min, lead, nil
+}
+
+// splitRecurringAdd cuts the schedule off at "каждый" so the rally parser
+// never sees it; options written after the schedule stay with the command.
+func splitRecurringAdd(text string) (cmd, schedule string, ok bool) {
+	words := strings.Fields(text)
+	for i, w := range words {
+		switch strings.ToLower(w) {
+		case "каждый", "каждую", "каждое":
+			var sched, opts []string
+			for _, w := range words[i:] {
+				if strings.Contains(w, "=") {
+					opts = append(opts, w)
+				} else {
+					sched = append(sched, w)
+				}
+			}
+			return strings.Join(append(words[:i:i], opts...), " "), strings.Join(sched, " "), true
+		}
+	}
+	return "", "", false
+}
+
+func parseRecurringAdd(text string, defaultLimit int) (Recurring, error) {
+	cmdText, schedule, ok := splitRecurringAdd(text)
+	if !ok {
+		return Recurring{}, fmt.Errorf(RECURRING_USAGE)
+	}
+	wd, hour, min, lead, err := parseSchedule(schedule)
+	if err != nil {
+		return Recurring{}, err
+	}
+	// The rally parser needs a date to find where the name ends, so it gets
+	// the first occurrence in place of the schedule.
+	cmd, err := parseCmdDefaultLimit(fmt.Sprintf("%s %s %d:%02d", cmdText, weekdayShort[wd], hour, min), defaultLimit)
+	if err != nil || cmd.Template != "" {
+		return Recurring{}, fmt.Errorf(RECURRING_USAGE)
+	}
+	return Recurring{
+		Name:    cmd.Name,
+		Limit:   cmd.Limit,
+		Weekday: wd,
+		Hour:    hour,
+		Minute:  min,
+		Lead:    lead,
+	}, nil
+}
+
+func nextOccurrence(d Recurring, after time.Time) time.Time {
+	after = after.In(location)
+	day := startOfDay(after)
+	for i := 0; i <= 7; i++ {
+		t := time.Date(day.Year(), day.Month(), day.Day()+i, d.Hour, d.Minute, 0, 0, location)
+		if t.Weekday() == d.Weekday && t.After(after) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func recurringJobID(id string) string {
+	return JOB_RECURRING + ":" + id
+}
+
+func armRecurring(d Recurring) {
+	if err := jobs.DeleteJob(recurringJobID(d.ID)); err != nil {
+		log.Printf("jobs delete error: %v", err)
+	}
+	if d.Paused {
+		return
+	}
+	at := d.NextAt.Add(-d.Lead)
+	if at.Before(time.Now()) {
+		at = time.Now()
+	}
+	err := jobs.AddJob(Job{ID: recurringJobID(d.ID), Kind: JOB_RECURRING, ChatID: d.ChatID, Ref: d.ID, At: at})
+	if err != nil {
+		log.Printf("jobs add error: %v", err)
+	}
+}
+
+func formatRecurring(d Recurring) string {
+	line := fmt.Sprintf("#%s «%s» каждый %s %02d:%02d, лимит %d, публикация за %d ч",
+		d.ID, html.EscapeString(d.Name), weekdayShort[d.Weekday], d.Hour, d.Minute, d.Limit, int(d.Lead/time.Hour))
+	if len(d.Regulars) > 0 {
+		var names []string
+		for _, e := range d.Regulars {
+			names = append(names, mention(e.UserID, e.Name))
+		}
+		line += ", постоянные: " + strings.Join(names, " ")
+	}
+	if d.Paused {
+		line += " ⏸"
+	}
+	return line
+}
+
+func runRecurring(bot *telego.Bot, ctx context.Context, j Job) {
+	d, ok, err := recurrings.GetRecurring(j.Ref)
+	if err != nil {
+		log.Printf("recurring get error: %v", err)
+		return
+	}
+	if !ok || d.Paused {
+		return
+	}
+	if d.NextAt.After(time.Now()) {
+		rally := Rally{
+			Name:        d.Name,
+			Date:        d.NextAt.In(location).Format("02.01.2006 15:04"),
+			Start:       d.NextAt,
+			Limit:       d.Limit,
+			Initiator:   d.OwnerName,
+			InitiatorID: d.OwnerID,
+			ChatID:      d.ChatID,
+			ThreadID:    d.ThreadID,
+			Status:      STATUS_OPEN,
+		}
+		rally.WaitingList = filterBanned(d.ChatID, d.Regulars)
+		promoteWaiting(&rally)
+		if _, err := publishRally(bot, ctx, rally); err != nil {
+			log.Printf("publish recurring %s error: %v", d.ID, err)
+		}
+	}
+	d.NextAt = nextOccurrence(d, d.NextAt)
+	if err := recurrings.SaveRecurring(d); err != nil {
+		log.Printf("recurring save error: %v", err)
+		return
+	}
+	armRecurring(d)
+}
+
+func handleRecurring(bot *telego.Bot, ctx context.Context, msg *telego.Message, text string) {
+	fields := strings.Fields(text)
+	if msg.From == nil {
+		return
+	}
+	if len(fields) < 2 || fields[1] == "list" {
+		list, err := recurrings.ListRecurring(msg.Chat.ID)
+		if err != nil {
+			log.Printf("recurring list error: %v", err)
+			return
+		}
+		lines := []string{"🔁 Повторяющиеся сборы:"}
+		for _, d := range list {
+			lines = append(lines, formatRecurring(d))
+		}
+		if len(list) == 0 {
+			lines = []string{"Повторяющихся сборов нет"}
+		}
+		_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
+			ChatID:          tu.ID(msg.Chat.ID),
+			Text:            strings.Join(lines, "\n"),
+			ParseMode:       "HTML",
+			MessageThreadID: msg.MessageThreadID,
+		})
+		return
+	}
+
+	if fields[1] == "add" {
+		if isBanned(msg.Chat.ID, msg.From.ID) {
+			setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+			return
+		}
+		s := settingsFor(msg.Chat.ID)
+		d, err := parseRecurringAdd(strings.Join(fields[1:], " "), s.DefaultLimit)
+		if err != nil {
+			rejectCommand(bot, ctx, msg, err.Error())
+			return
+		}
+		if !s.validLimit(d.Limit) {
+			rejectCommand(bot, ctx, msg, s.limitRangeMsg())
+			return
+		}
+		d.ID = strconv.FormatInt(time.Now().UnixMilli(), 36)
+		d.ChatID, d.ThreadID = msg.Chat.ID, msg.MessageThreadID
+		d.OwnerID, d.OwnerName = msg.From.ID, displayName(msg.From)
+		d.NextAt = nextOccurrence(d, time.Now())
+		if err := recurrings.SaveRecurring(d); err != nil {
+			log.Printf("recurring save error: %v", err)
+			setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+			return
+		}
+		armRecurring(d)
+		_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
+			ChatID:          tu.ID(msg.Chat.ID),
+			Text:            "🔁 Добавлен " + formatRecurring(d),
+			ParseMode:       "HTML",
+			MessageThreadID: msg.MessageThreadID,
+		})
+		return
+	}
+
+	if len(fields) < 3 {
+		rejectCommand(bot, ctx, msg, RECURRING_USAGE)
+		return
+	}
+	d, ok, err := recurrings.GetRecurring(strings.TrimPrefix(fields[2], "#"))
+	if err != nil || !ok || d.ChatID != msg.Chat.ID {
+		rejectCommand(bot, ctx, msg, RECURRING_404)
+		return
+	}
+	if d.OwnerID != msg.From.ID && !isAdmin(bot, ctx, msg.Chat.ID, msg.From) {
+		rejectCommand(bot, ctx, msg, EDIT_FORBIDDEN)
+		return
+	}
+
+	switch fields[1] {
+	case "pause":
+		d.Paused = true
+	case "resume":
+		d.Paused = false
+		d.NextAt = nextOccurrence(d, time.Now())
+	case "delete":
+		if err := recurrings.DeleteRecurring(d.ID); err != nil {
+			log.Printf("recurring delete error: %v", err)
+			setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+			return
+		}
+		if err := jobs.DeleteJob(recurringJobID(d.ID)); err != nil {
+			log.Printf("jobs delete error: %v", err)
+		}
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👍")
+		return
+	case "regulars":
+		d.Regulars = nil
+		for _, ref := range fields[3:] {
+			id, ok := resolveUserRef(ref)
+			if !ok {
+				rejectCommand(bot, ctx, msg, "Не знаю пользователя "+ref)
+				return
+			}
+			name := ref
+			if u, found, _ := users.LookupUser(id); found {
+				name = u.Name
+			}
+			d.Regulars = append(d.Regulars, Entry{UserID: id, Name: name})
+		}
+	default:
+		rejectCommand(bot, ctx, msg, RECURRING_USAGE)
+		return
+	}
+	if err := recurrings.SaveRecurring(d); err != nil {
+		log.Printf("recurring save error: %v", err)
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+		return
+	}
+	armRecurring(d)
+	setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👍")
+}
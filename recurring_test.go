@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRecurringAdd(t *testing.T) {
+	tests := []struct {
+		text  string
+		want  Recurring
+		fails bool
+	}{
+		{text: "add Рейд каждый чт 20:00 limit=8", want: Recurring{Name: "Рейд", Limit: 8, Weekday: time.Thursday, Hour: 20, Lead: RECURRING_LEAD}},
+		{text: "add Рейд 8 каждый чт 20:00", want: Recurring{Name: "Рейд", Limit: 8, Weekday: time.Thursday, Hour: 20, Lead: RECURRING_LEAD}},
+		{text: "add Ночной рейд каждую пт 21:30 за 48ч", want: Recurring{Name: "Ночной рейд", Limit: 6, Weekday: time.Friday, Hour: 21, Minute: 30, Lead: 48 * time.Hour}},
+		{text: "add Рейд чт 20:00 limit=8", fails: true},
+		{text: "add Рейд каждый 20:00", fails: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRecurringAdd(tt.text, 6)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tt.text, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	ROLE_ANY         = "любая"
+	ROLES_MAX        = 8
+	ROLE_NAME_MAX    = 20
+	ROLES_USAGE      = "роли= задаются так: роли=танк:2,хил:2,дд:6 (до 8 ролей, у каждой свой лимит)"
+	ROLES_LIMIT_MSG  = "У сбора с ролями лимит складывается из лимитов ролей"
+	ROLE_BUTTONS_ROW = 3
+)
+
+type Role struct {
+	Name  string
+	Limit int
+}
+
+var roleHeader = regexp.MustCompile(`^(.+) \((\d+)/(\d+)\):$`)
+
+func parseRoles(spec string) ([]Role, error) {
+	var roles []Role
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		name, limit, ok := strings.Cut(strings.TrimSpace(part), ":")
+		name = strings.TrimSpace(name)
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		key := strings.ToLower(name)
+		if !ok || err != nil || n <= 0 || name == "" || len([]rune(name)) > ROLE_NAME_MAX || seen[key] || key == ROLE_ANY || key == "any" {
+			return nil, cmdErr(ERR_BAD_OPTION, ROLES_USAGE)
+		}
+		seen[key] = true
+		roles = append(roles, Role{Name: name, Limit: n})
+	}
+	if len(roles) == 0 || len(roles) > ROLES_MAX {
+		return nil, cmdErr(ERR_BAD_OPTION, ROLES_USAGE)
+	}
+	return roles, nil
+}
+
+func rolesLimit(roles []Role) int {
+	total := 0
+	for _, role := range roles {
+		total += role.Limit
+	}
+	return total
+}
+
+func roleLabel(role string) string {
+	if role == "" {
+		return ROLE_ANY
+	}
+	return role
+}
+
+func roleEntries(r Rally, role string) []Entry {
+	var res []Entry
+	for _, e := range r.SignedUp {
+		if e.Role == role {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func roleHasRoom(r Rally, role string) bool {
+	for _, rl := range r.Roles {
+		if rl.Name == role {
+			return len(roleEntries(r, role)) < rl.Limit
+		}
+	}
+	return false
+}
+
+func freeRole(r Rally) string {
+	for _, rl := range r.Roles {
+		if roleHasRoom(r, rl.Name) {
+			return rl.Name
+		}
+	}
+	return ""
+}
+
+func placeEntry(r *Rally, e Entry, role string) {
+	if len(r.Roles) == 0 {
+		if len(r.SignedUp) < r.Limit {
+			r.SignedUp = append(r.SignedUp, e)
+		} else {
+			r.WaitingList = append(r.WaitingList, e)
+		}
+		return
+	}
+	if role == "" {
+		role = freeRole(*r)
+	}
+	e.Role = role
+	if role != "" && roleHasRoom(*r, role) {
+		r.SignedUp = append(r.SignedUp, e)
+		return
+	}
+	r.WaitingList = append(r.WaitingList, e)
+}
+
+func promoteRoles(r *Rally, mark func(Entry)) {
+	for moved := true; moved; {
+		moved = false
+		for i, e := range r.WaitingList {
+			role := e.Role
+			if role == "" {
+				role = freeRole(*r)
+			}
+			if role == "" || !roleHasRoom(*r, role) {
+				continue
+			}
+			e.Role = role
+			r.WaitingList = removeAtIndex(r.WaitingList, i)
+			r.SignedUp = append(r.SignedUp, e)
+			mark(e)
+			moved = true
+			break
+		}
+	}
+}
+
+func roleArg(r Rally, arg string) (string, bool) {
+	if len(r.Roles) == 0 || arg == "" || arg == "any" {
+		return "", true
+	}
+	i, err := strconv.Atoi(arg)
+	if err != nil || i < 0 || i >= len(r.Roles) {
+		return "", false
+	}
+	return r.Roles[i].Name, true
+}
+
+func roleButtons(r Rally) [][]telego.InlineKeyboardButton {
+	var rows [][]telego.InlineKeyboardButton
+	var row []telego.InlineKeyboardButton
+	for i, rl := range r.Roles {
+		label := fmt.Sprintf("%s %d/%d", rl.Name, len(roleEntries(r, rl.Name)), rl.Limit)
+		row = append(row, tu.InlineKeyboardButton(label).
+			WithCallbackData("sign_up:"+strconv.Itoa(i)).
+			WithStyle("success"))
+		if len(row) == ROLE_BUTTONS_ROW {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func formatRoleSections(sb *strings.Builder, r Rally) {
+	for _, rl := range r.Roles {
+		entries := roleEntries(r, rl.Name)
+		sb.WriteString(fmt.Sprintf("%s (%d/%d):\n", html.EscapeString(rl.Name), len(entries), rl.Limit))
+		for i := 0; i < rl.Limit; i++ {
+			if i < len(entries) {
+				sb.WriteString(fmt.Sprintf("%d) %s\n", i+1, formatSignedEntry(r, entries[i])))
+			} else {
+				sb.WriteString(fmt.Sprintf("%d)\n", i+1))
+			}
+		}
+	}
+}
+
+func parseRoleHeader(line string) (Role, bool) {
+	m := roleHeader.FindStringSubmatch(line)
+	if m == nil {
+		return Role{}, false
+	}
+	limit, err := strconv.Atoi(m[3])
+	if err != nil || limit <= 0 {
+		return Role{}, false
+	}
+	return Role{Name: m[1], Limit: limit}, true
+}
+
+func splitWaitingRole(line string) (string, string) {
+	i := strings.LastIndex(line, " — ")
+	if i == -1 {
+		return line, ""
+	}
+	role := line[i+len(" — "):]
+	if role == ROLE_ANY {
+		role = ""
+	}
+	return line[:i], role
+}
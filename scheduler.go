@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+type Job struct {
+	ID        string
+	Kind      string
+	ChatID    int64
+	MessageID int
+	Ref       string
+
+	InlineMessageID string `json:",omitempty"`
+	UserID          int64  `json:",omitempty"`
+	N               int    `json:",omitempty"`
+	At              time.Time
+}
+
+const (
+	JOB_REMIND_DAY  = "remind_day"
+	JOB_REMIND_HOUR = "remind_hour"
+	JOB_PENCIL      = "pencil"
+	JOB_DEADLINE    = "deadline"
+	JOB_FINISH      = "finish"
+	JOB_CONFIRM     = "confirm"
+	SCHEDULER_TICK  = 30 * time.Second
+	PENCIL_NUDGE    = 3 * time.Hour
+	JOB_GRACE       = 15 * time.Minute
+	ARCHIVE_EVERY   = time.Hour
+)
+
+var (
+	jobs          JobStore
+	lifecycleJobs = map[string]bool{JOB_DEADLINE: true, JOB_FINISH: true, JOB_CONFIRM: true}
+)
+
+func jobID(r Rally, kind string) string {
+	return rallyStoreKey(r) + ":" + kind
+}
+
+func rallyEnd(r Rally) time.Time {
+	if r.AllDay {
+		return r.Start.AddDate(0, 0, 1)
+	}
+	return r.Start
+}
+
+func jobPlan(r Rally) map[string]time.Time {
+	if r.Start.IsZero() {
+		return nil
+	}
+	plan := map[string]time.Time{JOB_FINISH: rallyEnd(r)}
+	if r.AllDay {
+		dayBefore := r.Start.AddDate(0, 0, -1)
+		plan[JOB_REMIND_DAY] = dayBefore.Add(10 * time.Hour)
+		plan[JOB_PENCIL] = dayBefore.Add(18 * time.Hour)
+	} else {
+		plan[JOB_REMIND_DAY] = r.Start.Add(-24 * time.Hour)
+		plan[JOB_REMIND_HOUR] = r.Start.Add(-time.Hour)
+		plan[JOB_PENCIL] = r.Start.Add(-PENCIL_NUDGE)
+	}
+	if r.Status == STATUS_CLOSED {
+		delete(plan, JOB_PENCIL)
+	} else if !r.Deadline.IsZero() {
+		plan[JOB_DEADLINE] = r.Deadline
+	}
+	if r.Min > 0 {
+		plan[JOB_DECIDE] = decisionTime(r)
+	}
+	return plan
+}
+
+func armRallyJobs(r Rally) {
+	if err := jobs.DeleteRallyJobs(rallyStoreKey(r)); err != nil {
+		log.Printf("jobs delete error: %v", err)
+	}
+	if r.Status != STATUS_OPEN && r.Status != STATUS_CLOSED {
+		return
+	}
+	now := time.Now()
+	for kind, at := range jobPlan(r) {
+		if r.InlineMessageID != "" && !lifecycleJobs[kind] && kind != JOB_DECIDE {
+			continue
+		}
+		if !at.After(now) {
+			if !lifecycleJobs[kind] {
+				continue
+			}
+			at = now
+		}
+		err := jobs.AddJob(Job{
+			ID:              jobID(r, kind),
+			Kind:            kind,
+			ChatID:          r.ChatID,
+			MessageID:       r.MessageID,
+			InlineMessageID: r.InlineMessageID,
+			At:              at,
+		})
+		if err != nil {
+			log.Printf("jobs add error: %v", err)
+		}
+	}
+	armConfirmJobs(r)
+}
+
+func cancelRallyJobs(r Rally) {
+	if err := jobs.DeleteRallyJobs(rallyStoreKey(r)); err != nil {
+		log.Printf("jobs delete error: %v", err)
+	}
+}
+
+func mentionList(lists ...[]Entry) string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, list := range lists {
+		for _, e := range list {
+			key := e.Name
+			if e.UserID != 0 {
+				key = strconv.FormatInt(e.UserID, 10)
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			names = append(names, mention(e.UserID, e.Name))
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func postToRally(bot *telego.Bot, ctx context.Context, r *Rally, text string) {
+	sent, err := bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID:          tu.ID(r.ChatID),
+		MessageThreadID: r.ThreadID,
+		Text:            text,
+		ParseMode:       "HTML",
+		ReplyParameters: &telego.ReplyParameters{
+			MessageID:                r.MessageID,
+			AllowSendingWithoutReply: true,
+		},
+	})
+	if err != nil {
+		log.Printf("send error: %v", err)
+		return
+	}
+	r.Linked = append(r.Linked, sent.MessageID)
+	if err := store.Save(*r); err != nil {
+		log.Printf("store save error: %v", err)
+	}
+}
+
+func jobLockKey(j Job) string {
+	if j.Kind == JOB_RECURRING {
+		return "chat:" + strconv.FormatInt(j.ChatID, 10)
+	}
+	if j.InlineMessageID != "" {
+		return inlineLockKey(j.InlineMessageID)
+	}
+	return rallyLockKey(j.ChatID, j.MessageID)
+}
+
+func runJob(bot *telego.Bot, ctx context.Context, j Job) {
+	if j.Kind == JOB_RECURRING {
+		runRecurring(bot, ctx, j)
+		return
+	}
+	if time.Since(j.At) > JOB_GRACE && !lifecycleJobs[j.Kind] && j.Kind != JOB_DECIDE {
+		log.Printf("skip stale job %s", j.ID)
+		return
+	}
+	var (
+		r   Rally
+		ok  bool
+		err error
+	)
+	if j.InlineMessageID != "" {
+		r, ok, err = store.GetInline(j.InlineMessageID)
+	} else {
+		r, ok, err = store.Get(j.ChatID, j.MessageID)
+	}
+	if err != nil {
+		log.Printf("store get error: %v", err)
+		return
+	}
+	if !ok || r.Status != STATUS_OPEN && r.Status != STATUS_CLOSED {
+		return
+	}
+
+	switch j.Kind {
+	case JOB_REMIND_DAY, JOB_REMIND_HOUR:
+		if len(r.SignedUp) == 0 {
+			return
+		}
+		when := "завтра"
+		if j.Kind == JOB_REMIND_HOUR {
+			when = "через час"
+		}
+		postToRally(bot, ctx, &r, fmt.Sprintf("⏰ Сбор «%s» %s (%s)\n%s", html.EscapeString(r.Name), when, html.EscapeString(r.Date), mentionList(r.SignedUp)))
+	case JOB_PENCIL:
+		if r.Status != STATUS_OPEN || len(r.PenciledIn) == 0 {
+			return
+		}
+		postToRally(bot, ctx, &r, fmt.Sprintf("✏️ Карандаш, решайтесь! Сбор «%s» скоро (%s)\n%s", html.EscapeString(r.Name), html.EscapeString(r.Date), mentionList(r.PenciledIn)))
+	case JOB_DEADLINE:
+		if r.Status != STATUS_OPEN {
+			return
+		}
+		r.Status = STATUS_CLOSED
+		if err := store.Save(r); err != nil {
+			log.Printf("store save error: %v", err)
+			return
+		}
+		refreshRallyMessage(r)
+	case JOB_FINISH:
+		r.Status = STATUS_FINISHED
+		r.FinishedAt = time.Now()
+		if err := store.Save(r); err != nil {
+			log.Printf("store save error: %v", err)
+			return
+		}
+		refreshRallyMessage(r)
+	case JOB_CONFIRM:
+		expirePending(bot, ctx, r, j)
+	case JOB_DECIDE:
+		decideRally(bot, ctx, r)
+	default:
+		log.Printf("unknown job kind %q", j.Kind)
+	}
+}
+
+func runScheduler(bot *telego.Bot, ctx context.Context, stop <-chan struct{}, disp *dispatcher) {
+	ticker := time.NewTicker(SCHEDULER_TICK)
+	defer ticker.Stop()
+	var lastArchive time.Time
+	for {
+		if cfg.ArchiveAfter > 0 && time.Since(lastArchive) >= ARCHIVE_EVERY {
+			lastArchive = time.Now()
+			n, err := store.Archive(lastArchive.Add(-cfg.ArchiveAfter))
+			if err != nil {
+				log.Printf("archive rallies error: %v", err)
+			} else if n > 0 {
+				log.Printf("archived %d rallies", n)
+			}
+		}
+		if err := bans.PurgeExpiredBans(time.Now()); err != nil {
+			log.Printf("purge bans error: %v", err)
+		}
+		expireWizards(bot, ctx, time.Now())
+		expireFriendPrompts(bot, ctx, time.Now())
+		due, err := jobs.DueJobs(time.Now())
+		if err != nil {
+			log.Printf("jobs due error: %v", err)
+		}
+		for _, j := range due {
+			if err := jobs.DeleteJob(j.ID); err != nil {
+				log.Printf("jobs delete error: %v", err)
+				continue
+			}
+			disp.Do(jobLockKey(j), func() {
+				runJob(bot, ctx, j)
+			})
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
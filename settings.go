@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	SETTINGS_PREFIX    = "st:"
+	SETTINGS_USAGE     = "Используйте:\n/settings — меню настроек чата\n/settings <параметр> <значение>\n/settings <параметр> reset — вернуть значение по умолчанию\nПараметры: limit_min, limit_max, max_friends, default_limit, pencil (on/off), delete_on_cancel (on/off)"
+	SETTINGS_FORBIDDEN = "Настройки чата меняют только администраторы"
+	SETTINGS_PRIVATE   = "Настройки задаются в групповом чате"
+	PENCIL_DISABLED    = "Карандаш в этом чате отключён"
+)
+
+type ChatSettings struct {
+	ChatID         int64
+	LimitMin       *int  `json:",omitempty"`
+	LimitMax       *int  `json:",omitempty"`
+	MaxPlusFriends *int  `json:",omitempty"`
+	DefaultLimit   *int  `json:",omitempty"`
+	PencilAllowed  *bool `json:",omitempty"`
+	DeleteOnCancel *bool `json:",omitempty"`
+}
+
+type Settings struct {
+	LimitMin       int
+	LimitMax       int
+	MaxPlusFriends int
+	DefaultLimit   int
+	PencilAllowed  bool
+	DeleteOnCancel bool
+}
+
+var chatSettings SettingsStore
+
+func loadChatSettings(chatID int64) ChatSettings {
+	s, ok, err := chatSettings.GetSettings(chatID)
+	if err != nil {
+		log.Printf("settings get error: %v", err)
+	}
+	if !ok {
+		s = ChatSettings{ChatID: chatID}
+	}
+	return s
+}
+
+func (cs ChatSettings) resolve() Settings {
+	s := Settings{
+		LimitMin:       cfg.LimitMin,
+		LimitMax:       cfg.LimitMax,
+		MaxPlusFriends: cfg.MaxPlusFriends,
+		PencilAllowed:  true,
+	}
+	if cs.LimitMin != nil {
+		s.LimitMin = *cs.LimitMin
+	}
+	if cs.LimitMax != nil {
+		s.LimitMax = *cs.LimitMax
+	}
+	if cs.MaxPlusFriends != nil {
+		s.MaxPlusFriends = *cs.MaxPlusFriends
+	}
+	if cs.DefaultLimit != nil {
+		s.DefaultLimit = *cs.DefaultLimit
+	}
+	if cs.PencilAllowed != nil {
+		s.PencilAllowed = *cs.PencilAllowed
+	}
+	if cs.DeleteOnCancel != nil {
+		s.DeleteOnCancel = *cs.DeleteOnCancel
+	}
+	return s
+}
+
+func settingsFor(chatID int64) Settings {
+	if chatID == 0 {
+		return ChatSettings{}.resolve()
+	}
+	return loadChatSettings(chatID).resolve()
+}
+
+func (s Settings) limitRangeMsg() string {
+	return fmt.Sprintf("Лимит должен быть от %d до %d", s.LimitMin, s.LimitMax)
+}
+
+func (s Settings) validLimit(n int) bool {
+	return n >= s.LimitMin && n <= s.LimitMax
+}
+
+func (s Settings) validate() error {
+	if s.LimitMin < 1 || s.LimitMin > s.LimitMax || s.LimitMax > LIMIT_HARD_MAX {
+		return fmt.Errorf("Лимиты должны быть в пределах 1 ≤ limit_min ≤ limit_max ≤ %d", LIMIT_HARD_MAX)
+	}
+	if s.MaxPlusFriends < 0 || s.MaxPlusFriends > FRIENDS_HARD_MAX {
+		return fmt.Errorf("max_friends должен быть от 0 до %d", FRIENDS_HARD_MAX)
+	}
+	if s.DefaultLimit != 0 && !s.validLimit(s.DefaultLimit) {
+		return fmt.Errorf("default_limit должен быть от %d до %d", s.LimitMin, s.LimitMax)
+	}
+	return nil
+}
+
+func parseSwitch(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "on", "true", "1", "да", "вкл":
+		return true, true
+	case "off", "false", "0", "нет", "выкл":
+		return false, true
+	}
+	return false, false
+}
+
+func setSetting(cs *ChatSettings, key, value string) bool {
+	var intField **int
+	var boolField **bool
+	switch key {
+	case "limit_min":
+		intField = &cs.LimitMin
+	case "limit_max":
+		intField = &cs.LimitMax
+	case "max_friends":
+		intField = &cs.MaxPlusFriends
+	case "default_limit":
+		intField = &cs.DefaultLimit
+	case "pencil":
+		boolField = &cs.PencilAllowed
+	case "delete_on_cancel":
+		boolField = &cs.DeleteOnCancel
+	default:
+		return false
+	}
+	switch {
+	case value == "reset" && intField != nil:
+		*intField = nil
+	case value == "reset":
+		*boolField = nil
+	case intField != nil:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return false
+		}
+		*intField = &n
+	default:
+		v, ok := parseSwitch(value)
+		if !ok {
+			return false
+		}
+		*boolField = &v
+	}
+	return true
+}
+
+func onOff(v bool) string {
+	if v {
+		return "вкл"
+	}
+	return "выкл"
+}
+
+func formatSettings(cs ChatSettings) string {
+	s := cs.resolve()
+	source := func(set bool) string {
+		if !set {
+			return " (по умолчанию)"
+		}
+		return ""
+	}
+	defLimit := "нет"
+	if s.DefaultLimit > 0 {
+		defLimit = strconv.Itoa(s.DefaultLimit)
+	}
+	return fmt.Sprintf("⚙️ Настройки чата\n"+
+		"Лимит: от %d%s до %d%s\n"+
+		"Друзей на человека: %d%s\n"+
+		"Лимит по умолчанию: %s%s\n"+
+		"Карандаш: %s%s\n"+
+		"Удалять сообщение при отмене: %s%s\n\n"+
+		"Границы лимита меняются командой /settings limit_min|limit_max <число>",
+		s.LimitMin, source(cs.LimitMin != nil), s.LimitMax, source(cs.LimitMax != nil),
+		s.MaxPlusFriends, source(cs.MaxPlusFriends != nil),
+		defLimit, source(cs.DefaultLimit != nil),
+		onOff(s.PencilAllowed), source(cs.PencilAllowed != nil),
+		onOff(s.DeleteOnCancel), source(cs.DeleteOnCancel != nil),
+	)
+}
+
+func settingsButton(text, data string) telego.InlineKeyboardButton {
+	return tu.InlineKeyboardButton(text).WithCallbackData(SETTINGS_PREFIX + data)
+}
+
+func settingsKeyboard(cs ChatSettings) *telego.InlineKeyboardMarkup {
+	s := cs.resolve()
+	defLimit := "нет"
+	if s.DefaultLimit > 0 {
+		defLimit = strconv.Itoa(s.DefaultLimit)
+	}
+	return tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			settingsButton("Друзей −", "friends:-1"),
+			settingsButton(strconv.Itoa(s.MaxPlusFriends), "noop"),
+			settingsButton("Друзей +", "friends:+1"),
+		),
+		tu.InlineKeyboardRow(
+			settingsButton("Лимит −", "default_limit:-1"),
+			settingsButton(defLimit, "noop"),
+			settingsButton("Лимит +", "default_limit:+1"),
+		),
+		tu.InlineKeyboardRow(settingsButton("Карандаш: "+onOff(s.PencilAllowed), "pencil")),
+		tu.InlineKeyboardRow(settingsButton("Удалять при отмене: "+onOff(s.DeleteOnCancel), "delete_on_cancel")),
+		tu.InlineKeyboardRow(
+			settingsButton("Сбросить", "reset"),
+			settingsButton("Готово", "close").WithStyle("success"),
+		),
+	)
+}
+
+func handleSettings(bot *telego.Bot, ctx context.Context, msg *telego.Message, text string) {
+	if msg.Chat.Type == telego.ChatTypePrivate {
+		rejectCommand(bot, ctx, msg, SETTINGS_PRIVATE)
+		return
+	}
+	if !canManageChat(bot, ctx, msg.Chat.ID, msg.From) {
+		rejectCommand(bot, ctx, msg, SETTINGS_FORBIDDEN)
+		return
+	}
+	cs := loadChatSettings(msg.Chat.ID)
+	fields := strings.Fields(text)
+	if len(fields) == 1 {
+		_, err := bot.SendMessage(ctx, &telego.SendMessageParams{
+			ChatID:          tu.ID(msg.Chat.ID),
+			MessageThreadID: msg.MessageThreadID,
+			Text:            formatSettings(cs),
+			ReplyMarkup:     settingsKeyboard(cs),
+		})
+		if err != nil {
+			log.Printf("send error: %v", err)
+		}
+		return
+	}
+	if len(fields) != 3 || !setSetting(&cs, fields[1], fields[2]) {
+		rejectCommand(bot, ctx, msg, SETTINGS_USAGE)
+		return
+	}
+	if err := cs.resolve().validate(); err != nil {
+		rejectCommand(bot, ctx, msg, err.Error())
+		return
+	}
+	if err := chatSettings.SaveSettings(cs); err != nil {
+		log.Printf("settings save error: %v", err)
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+		return
+	}
+	setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👍")
+}
+
+func handleSettingsCallback(bot *telego.Bot, ctx context.Context, cb *telego.CallbackQuery) {
+	if cb.Message == nil {
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	chatID := cb.Message.GetChat().ID
+	if !canManageChat(bot, ctx, chatID, &cb.From) {
+		sendCallback(bot, ctx, cb.ID, SETTINGS_FORBIDDEN)
+		return
+	}
+	cs := loadChatSettings(chatID)
+	s := cs.resolve()
+	action, arg, _ := strings.Cut(strings.TrimPrefix(cb.Data, SETTINGS_PREFIX), ":")
+	delta, _ := strconv.Atoi(arg)
+
+	switch action {
+	case "friends":
+		n := s.MaxPlusFriends + delta
+		if n < 0 || n > FRIENDS_HARD_MAX {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		cs.MaxPlusFriends = &n
+	case "default_limit":
+		n := s.DefaultLimit + delta
+		switch {
+		case s.DefaultLimit == 0 && delta > 0:
+			n = s.LimitMin
+		case n < s.LimitMin:
+			n = 0
+		case n > s.LimitMax:
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		cs.DefaultLimit = &n
+	case "pencil":
+		v := !s.PencilAllowed
+		cs.PencilAllowed = &v
+	case "delete_on_cancel":
+		v := !s.DeleteOnCancel
+		cs.DeleteOnCancel = &v
+	case "reset":
+		cs = ChatSettings{ChatID: chatID}
+	case "close":
+		_ = bot.DeleteMessage(ctx, &telego.DeleteMessageParams{
+			ChatID:    tu.ID(chatID),
+			MessageID: cb.Message.GetMessageID(),
+		})
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	default:
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+
+	if err := cs.resolve().validate(); err != nil {
+		sendCallback(bot, ctx, cb.ID, err.Error())
+		return
+	}
+	if err := chatSettings.SaveSettings(cs); err != nil {
+		log.Printf("settings save error: %v", err)
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	edits.Enqueue(&telego.EditMessageTextParams{
+		ChatID:      tu.ID(chatID),
+		MessageID:   cb.Message.GetMessageID(),
+		Text:        formatSettings(cs),
+		ReplyMarkup: settingsKeyboard(cs),
+	})
+	sendSilentCallback(bot, ctx, cb.ID)
+}
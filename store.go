@@ -0,0 +1,678 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RallyStore interface {
+	Get(chatID int64, messageID int) (Rally, bool, error)
+	GetInline(inlineMessageID string) (Rally, bool, error)
+	Save(r Rally) error
+	Delete(r Rally) error
+	List(chatID int64) ([]Rally, error)
+	Archive(before time.Time) (int, error)
+}
+
+type JobStore interface {
+	AddJob(j Job) error
+	DueJobs(now time.Time) ([]Job, error)
+	DeleteJob(id string) error
+	DeleteRallyJobs(key string) error
+}
+
+type UserDirectory interface {
+	RememberUser(u KnownUser) error
+	LookupUsername(username string) (KnownUser, bool, error)
+	LookupUser(id int64) (KnownUser, bool, error)
+}
+
+type ChatDirectory interface {
+	RememberChat(c KnownChat, userID int64) error
+	ChatsOf(userID int64) ([]KnownChat, error)
+}
+
+type SettingsStore interface {
+	GetSettings(chatID int64) (ChatSettings, bool, error)
+	SaveSettings(s ChatSettings) error
+}
+
+type NotifyStore interface {
+	GetNotify(userID int64) (NotifyPrefs, bool, error)
+	SaveNotify(p NotifyPrefs) error
+}
+
+type BanStore interface {
+	AddBan(b Ban) error
+	RemoveBan(chatID, userID int64) error
+	ListBans(chatID int64, now time.Time) ([]Ban, error)
+	ClearBans(chatID int64) error
+	PurgeExpiredBans(now time.Time) error
+}
+
+type RecurringStore interface {
+	SaveRecurring(d Recurring) error
+	GetRecurring(id string) (Recurring, bool, error)
+	ListRecurring(chatID int64) ([]Recurring, error)
+	DeleteRecurring(id string) error
+}
+
+type TemplateStore interface {
+	SaveTemplate(t Template) error
+	GetTemplate(chatID int64, key string) (Template, bool, error)
+	ListTemplates(chatID int64) ([]Template, error)
+	DeleteTemplate(chatID int64, key string) error
+}
+
+type rallyFile struct {
+	Rallies map[string]Rally `json:"rallies"`
+}
+
+type jobFile struct {
+	Jobs map[string]Job `json:"jobs"`
+}
+
+type stateFile struct {
+	Users     map[string]KnownUser    `json:"users"`
+	Chats     map[string]KnownChat    `json:"chats"`
+	Bans      map[string]Ban          `json:"bans"`
+	Recurring map[string]Recurring    `json:"recurring"`
+	Templates map[string]Template     `json:"templates"`
+	Settings  map[string]ChatSettings `json:"settings"`
+	Notify    map[string]NotifyPrefs  `json:"notify"`
+}
+
+type storeData struct {
+	rallyFile
+	jobFile
+	stateFile
+}
+
+type storePart int
+
+const (
+	partRallies storePart = iota
+	partJobs
+	partState
+)
+
+type fileStore struct {
+	mu   sync.Mutex
+	path string
+	data storeData
+}
+
+func rallyKey(chatID int64, messageID int) string {
+	return fmt.Sprintf("%d:%d", chatID, messageID)
+}
+
+func inlineRallyKey(inlineMessageID string) string {
+	return "inline:" + inlineMessageID
+}
+
+func rallyStoreKey(r Rally) string {
+	if r.InlineMessageID != "" {
+		return inlineRallyKey(r.InlineMessageID)
+	}
+	return rallyKey(r.ChatID, r.MessageID)
+}
+
+func jobRallyKey(j Job) string {
+	if j.InlineMessageID != "" {
+		return inlineRallyKey(j.InlineMessageID)
+	}
+	return rallyKey(j.ChatID, j.MessageID)
+}
+
+func cloneRally(r Rally) Rally {
+	r.SignedUp = append([]Entry(nil), r.SignedUp...)
+	r.WaitingList = append([]Entry(nil), r.WaitingList...)
+	r.PenciledIn = append([]Entry(nil), r.PenciledIn...)
+	r.Linked = append([]int(nil), r.Linked...)
+	r.Pending = append([]Pending(nil), r.Pending...)
+	return r
+}
+
+func sidePath(path, name string) string {
+	return strings.TrimSuffix(path, ".json") + "." + name
+}
+
+func (s *fileStore) partPath(part storePart) string {
+	switch part {
+	case partJobs:
+		return sidePath(s.path, "jobs.json")
+	case partState:
+		return sidePath(s.path, "state.json")
+	}
+	return s.path
+}
+
+func readJSON(path string, v any) (bool, error) {
+	raw, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, fmt.Errorf("decode %s: %w", path, err)
+	}
+	return true, nil
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{path: path}
+	// Older versions kept everything in one file, so the main file is read
+	// as a whole and the side files, once they exist, take precedence.
+	if _, err := readJSON(path, &s.data); err != nil {
+		return nil, err
+	}
+	migrate := false
+	for _, part := range []storePart{partJobs, partState} {
+		var fresh storeData
+		ok, err := readJSON(s.partPath(part), fresh.partPtr(part))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			s.data.setPart(part, fresh)
+		} else {
+			migrate = true
+		}
+	}
+	if s.data.Rallies == nil {
+		s.data.Rallies = make(map[string]Rally)
+	}
+	if s.data.Jobs == nil {
+		s.data.Jobs = make(map[string]Job)
+	}
+	if s.data.Users == nil {
+		s.data.Users = make(map[string]KnownUser)
+	}
+	if s.data.Chats == nil {
+		s.data.Chats = make(map[string]KnownChat)
+	}
+	if s.data.Bans == nil {
+		s.data.Bans = make(map[string]Ban)
+	}
+	if s.data.Recurring == nil {
+		s.data.Recurring = make(map[string]Recurring)
+	}
+	if s.data.Templates == nil {
+		s.data.Templates = make(map[string]Template)
+	}
+	if s.data.Settings == nil {
+		s.data.Settings = make(map[string]ChatSettings)
+	}
+	if s.data.Notify == nil {
+		s.data.Notify = make(map[string]NotifyPrefs)
+	}
+	if migrate {
+		if err := s.flushAllLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (d *storeData) partPtr(part storePart) any {
+	switch part {
+	case partJobs:
+		return &d.jobFile
+	case partState:
+		return &d.stateFile
+	}
+	return &d.rallyFile
+}
+
+func (d *storeData) setPart(part storePart, from storeData) {
+	switch part {
+	case partJobs:
+		d.jobFile = from.jobFile
+	case partState:
+		d.stateFile = from.stateFile
+	default:
+		d.rallyFile = from.rallyFile
+	}
+}
+
+func (s *fileStore) flushLocked(part storePart) error {
+	path := s.partPath(part)
+	raw, err := json.MarshalIndent(s.data.partPtr(part), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fileStore) flushAllLocked() error {
+	for _, part := range []storePart{partJobs, partState, partRallies} {
+		if err := s.flushLocked(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushAllLocked()
+}
+
+func (s *fileStore) Get(chatID int64, messageID int) (Rally, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.data.Rallies[rallyKey(chatID, messageID)]
+	return cloneRally(r), ok, nil
+}
+
+func (s *fileStore) GetInline(inlineMessageID string) (Rally, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.data.Rallies[inlineRallyKey(inlineMessageID)]
+	return cloneRally(r), ok, nil
+}
+
+func (s *fileStore) Save(r Rally) error {
+	if r.MessageID == 0 && r.InlineMessageID == "" {
+		return fmt.Errorf("rally has no message id")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Rallies[rallyStoreKey(r)] = cloneRally(r)
+	return s.flushLocked(partRallies)
+}
+
+func (s *fileStore) Delete(r Rally) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := rallyStoreKey(r)
+	delete(s.data.Rallies, key)
+	for id, j := range s.data.Jobs {
+		if jobRallyKey(j) == key {
+			delete(s.data.Jobs, id)
+		}
+	}
+	if err := s.flushLocked(partJobs); err != nil {
+		return err
+	}
+	return s.flushLocked(partRallies)
+}
+
+func (s *fileStore) List(chatID int64) ([]Rally, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []Rally
+	for _, r := range s.data.Rallies {
+		if r.ChatID == chatID {
+			res = append(res, cloneRally(r))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].MessageID < res[j].MessageID })
+	return res, nil
+}
+
+func archivable(r Rally, before time.Time) bool {
+	switch r.Status {
+	case STATUS_FINISHED:
+		return !r.FinishedAt.IsZero() && r.FinishedAt.Before(before)
+	case STATUS_CANCELLED:
+		return !r.Start.IsZero() && r.Start.Before(before)
+	}
+	return false
+}
+
+// Archive moves finished and cancelled rallies older than before out of the
+// live file into an append-only JSON Lines archive kept for statistics.
+func (s *fileStore) Archive(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	var buf []byte
+	for key, r := range s.data.Rallies {
+		if !archivable(r, before) {
+			continue
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, key)
+		buf = append(append(buf, line...), '\n')
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	f, err := os.OpenFile(sidePath(s.path, "archive.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		delete(s.data.Rallies, key)
+	}
+	return len(keys), s.flushLocked(partRallies)
+}
+
+func (s *fileStore) AddJob(j Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Jobs[j.ID] = j
+	return s.flushLocked(partJobs)
+}
+
+func (s *fileStore) DueJobs(now time.Time) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []Job
+	for _, j := range s.data.Jobs {
+		if !j.At.After(now) {
+			res = append(res, j)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].At.Before(res[j].At) })
+	return res, nil
+}
+
+func (s *fileStore) DeleteJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Jobs[id]; !ok {
+		return nil
+	}
+	delete(s.data.Jobs, id)
+	return s.flushLocked(partJobs)
+}
+
+func (s *fileStore) DeleteRallyJobs(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for id, j := range s.data.Jobs {
+		if jobRallyKey(j) == key {
+			delete(s.data.Jobs, id)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.flushLocked(partJobs)
+}
+
+func (s *fileStore) RememberUser(u KnownUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strconv.FormatInt(u.ID, 10)
+	if s.data.Users[key] == u {
+		return nil
+	}
+	s.data.Users[key] = u
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) LookupUsername(username string) (KnownUser, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.data.Users {
+		if u.Username != "" && u.Username == username {
+			return u, true, nil
+		}
+	}
+	return KnownUser{}, false, nil
+}
+
+func (s *fileStore) LookupUser(id int64) (KnownUser, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.data.Users[strconv.FormatInt(id, 10)]
+	return u, ok, nil
+}
+
+func (s *fileStore) RememberChat(c KnownChat, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strconv.FormatInt(c.ID, 10)
+	old, ok := s.data.Chats[key]
+	c.Members = old.Members
+	known := false
+	for _, id := range c.Members {
+		if id == userID {
+			known = true
+			break
+		}
+	}
+	if ok && known && old.Title == c.Title {
+		return nil
+	}
+	if !known {
+		c.Members = append(append([]int64(nil), c.Members...), userID)
+	}
+	s.data.Chats[key] = c
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) ChatsOf(userID int64) ([]KnownChat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []KnownChat
+	for _, c := range s.data.Chats {
+		for _, id := range c.Members {
+			if id == userID {
+				c.Members = nil
+				res = append(res, c)
+				break
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Title < res[j].Title })
+	return res, nil
+}
+
+func banKey(chatID, userID int64) string {
+	return fmt.Sprintf("%d:%d", chatID, userID)
+}
+
+func (s *fileStore) AddBan(b Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Bans[banKey(b.ChatID, b.UserID)] = b
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) RemoveBan(chatID, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := banKey(chatID, userID)
+	if _, ok := s.data.Bans[key]; !ok {
+		return nil
+	}
+	delete(s.data.Bans, key)
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) ListBans(chatID int64, now time.Time) ([]Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []Ban
+	for _, b := range s.data.Bans {
+		if (b.ChatID == chatID || b.ChatID == GLOBAL_BAN) && !b.Expired(now) {
+			res = append(res, b)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+	return res, nil
+}
+
+func (s *fileStore) ClearBans(chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, b := range s.data.Bans {
+		if b.ChatID == chatID {
+			delete(s.data.Bans, key)
+		}
+	}
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) PurgeExpiredBans(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for key, b := range s.data.Bans {
+		if b.Expired(now) {
+			delete(s.data.Bans, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) SaveRecurring(d Recurring) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.Regulars = append([]Entry(nil), d.Regulars...)
+	s.data.Recurring[d.ID] = d
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) GetRecurring(id string) (Recurring, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.data.Recurring[id]
+	d.Regulars = append([]Entry(nil), d.Regulars...)
+	return d, ok, nil
+}
+
+func (s *fileStore) ListRecurring(chatID int64) ([]Recurring, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []Recurring
+	for _, d := range s.data.Recurring {
+		if d.ChatID == chatID {
+			d.Regulars = append([]Entry(nil), d.Regulars...)
+			res = append(res, d)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+func (s *fileStore) DeleteRecurring(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Recurring[id]; !ok {
+		return nil
+	}
+	delete(s.data.Recurring, id)
+	return s.flushLocked(partState)
+}
+
+func templateStoreKey(chatID int64, key string) string {
+	return fmt.Sprintf("%d:%s", chatID, key)
+}
+
+func (s *fileStore) SaveTemplate(t Template) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Templates[templateStoreKey(t.ChatID, t.Key)] = t
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) GetTemplate(chatID int64, key string) (Template, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.data.Templates[templateStoreKey(chatID, key)]
+	return t, ok, nil
+}
+
+func (s *fileStore) ListTemplates(chatID int64) ([]Template, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []Template
+	for _, t := range s.data.Templates {
+		if t.ChatID == chatID {
+			res = append(res, t)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res, nil
+}
+
+func (s *fileStore) DeleteTemplate(chatID int64, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := templateStoreKey(chatID, key)
+	if _, ok := s.data.Templates[k]; !ok {
+		return nil
+	}
+	delete(s.data.Templates, k)
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) GetSettings(chatID int64) (ChatSettings, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs, ok := s.data.Settings[strconv.FormatInt(chatID, 10)]
+	return cs, ok, nil
+}
+
+func (s *fileStore) SaveSettings(cs ChatSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Settings[strconv.FormatInt(cs.ChatID, 10)] = cs
+	return s.flushLocked(partState)
+}
+
+func (s *fileStore) GetNotify(userID int64) (NotifyPrefs, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.data.Notify[strconv.FormatInt(userID, 10)]
+	return p, ok, nil
+}
+
+func (s *fileStore) SaveNotify(p NotifyPrefs) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Notify[strconv.FormatInt(p.UserID, 10)] = p
+	return s.flushLocked(partState)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStoreMigratesSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rallies.json")
+	old := map[string]any{
+		"rallies": map[string]Rally{"1:2": {Name: "Башня", ChatID: 1, MessageID: 2}},
+		"jobs":    map[string]Job{"1:2:finish": {ID: "1:2:finish", Kind: JOB_FINISH, ChatID: 1, MessageID: 2}},
+		"users":   map[string]KnownUser{"7": {ID: 7, Username: "vasya"}},
+	}
+	raw, err := json.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openFileStore(path); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(rest), "vasya") || strings.Contains(string(rest), JOB_FINISH) {
+		t.Errorf("main file still holds jobs or users: %s", rest)
+	}
+
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.Get(1, 2); !ok {
+		t.Error("rally lost after migration")
+	}
+	if _, ok, _ := s.LookupUsername("vasya"); !ok {
+		t.Error("user lost after migration")
+	}
+	if due, _ := s.DueJobs(time.Now()); len(due) != 1 {
+		t.Errorf("jobs after migration = %d, want 1", len(due))
+	}
+}
+
+func TestFileStoreArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rallies.json")
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	rallies := []Rally{
+		{Name: "old", ChatID: 1, MessageID: 1, Status: STATUS_FINISHED, FinishedAt: now.AddDate(0, 0, -40)},
+		{Name: "recent", ChatID: 1, MessageID: 2, Status: STATUS_FINISHED, FinishedAt: now.AddDate(0, 0, -1)},
+		{Name: "cancelled", ChatID: 1, MessageID: 3, Status: STATUS_CANCELLED, Start: now.AddDate(0, 0, -40)},
+		{Name: "open", ChatID: 1, MessageID: 4, Status: STATUS_OPEN, Start: now.AddDate(0, 0, -40)},
+	}
+	for _, r := range rallies {
+		if err := s.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := s.Archive(now.AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("archived %d rallies, want 2", n)
+	}
+	left, _ := s.List(1)
+	if len(left) != 2 || left[0].Name != "recent" || left[1].Name != "open" {
+		t.Errorf("left = %+v", left)
+	}
+	raw, err := os.ReadFile(sidePath(path, "archive.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(raw)), "\n"); len(lines) != 2 {
+		t.Errorf("archive has %d lines, want 2", len(lines))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	TEMPLATE_USAGE = "Используйте:\n/template save <ключ> — ответом на сообщение сбора\n/template list\n/template delete <ключ>\nСоздание сбора по шаблону: /сбор @ключ [лимит] <дата>"
+	TEMPLATE_404   = "Шаблон не найден"
+)
+
+type Template struct {
+	ChatID      int64
+	Key         string
+	Name        string
+	Limit       int
+	Description string
+	Place       string
+	OwnerID     int64
+	Roles       []Role `json:",omitempty"`
+}
+
+var templates TemplateStore
+
+func templateKey(s string) string {
+	s = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "@"))
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return ""
+		}
+	}
+	return s
+}
+
+func applyTemplate(c *rallyCmd, chatID int64) error {
+	t, ok, err := templates.GetTemplate(chatID, c.Template)
+	if err != nil {
+		log.Printf("template get error: %v", err)
+	}
+	if err != nil || !ok {
+		return fmt.Errorf(TEMPLATE_404)
+	}
+	c.Name = t.Name
+	if len(c.Roles) == 0 && len(t.Roles) > 0 {
+		if c.Limit != 0 && c.Limit != rolesLimit(t.Roles) {
+			return fmt.Errorf(ROLES_LIMIT_MSG)
+		}
+		c.Roles = append([]Role(nil), t.Roles...)
+		c.Limit = rolesLimit(t.Roles)
+	}
+	if c.Limit == 0 {
+		c.Limit = t.Limit
+	}
+	if c.Description == "" {
+		c.Description = t.Description
+	}
+	if c.Place == "" {
+		c.Place = t.Place
+	}
+	return nil
+}
+
+func formatTemplate(t Template) string {
+	line := fmt.Sprintf("@%s — «%s», лимит %d", t.Key, html.EscapeString(t.Name), t.Limit)
+	if len(t.Roles) > 0 {
+		roles := make([]string, len(t.Roles))
+		for i, rl := range t.Roles {
+			roles[i] = fmt.Sprintf("%s:%d", html.EscapeString(rl.Name), rl.Limit)
+		}
+		line += ", роли " + strings.Join(roles, ",")
+	}
+	if t.Place != "" {
+		line += ", " + html.EscapeString(t.Place)
+	}
+	return line
+}
+
+func handleTemplate(bot *telego.Bot, ctx context.Context, msg *telego.Message, text string) {
+	fields := strings.Fields(text)
+	if msg.From == nil || len(fields) < 2 {
+		rejectCommand(bot, ctx, msg, TEMPLATE_USAGE)
+		return
+	}
+	switch fields[1] {
+	case "list":
+		list, err := templates.ListTemplates(msg.Chat.ID)
+		if err != nil {
+			log.Printf("template list error: %v", err)
+			return
+		}
+		lines := []string{"📋 Шаблоны:"}
+		for _, t := range list {
+			lines = append(lines, formatTemplate(t))
+		}
+		if len(list) == 0 {
+			lines = []string{"Шаблонов нет"}
+		}
+		_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
+			ChatID:          tu.ID(msg.Chat.ID),
+			Text:            strings.Join(lines, "\n"),
+			ParseMode:       "HTML",
+			MessageThreadID: msg.MessageThreadID,
+		})
+
+	case "save":
+		key := ""
+		if len(fields) > 2 {
+			key = templateKey(fields[2])
+		}
+		if key == "" || msg.ReplyToMessage == nil || isBanned(msg.Chat.ID, msg.From.ID) {
+			rejectCommand(bot, ctx, msg, TEMPLATE_USAGE)
+			return
+		}
+		r, err := loadRally(msg.ReplyToMessage)
+		if err != nil {
+			rejectCommand(bot, ctx, msg, TEMPLATE_USAGE)
+			return
+		}
+		if old, ok, _ := templates.GetTemplate(msg.Chat.ID, key); ok && old.OwnerID != msg.From.ID && !isAdmin(bot, ctx, msg.Chat.ID, msg.From) {
+			rejectCommand(bot, ctx, msg, EDIT_FORBIDDEN)
+			return
+		}
+		err = templates.SaveTemplate(Template{
+			ChatID:      msg.Chat.ID,
+			Key:         key,
+			Name:        r.Name,
+			Limit:       r.Limit,
+			Description: r.Description,
+			Place:       r.Place,
+			OwnerID:     msg.From.ID,
+			Roles:       r.Roles,
+		})
+		if err != nil {
+			log.Printf("template save error: %v", err)
+			setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+			return
+		}
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👍")
+
+	case "delete":
+		if len(fields) < 3 {
+			rejectCommand(bot, ctx, msg, TEMPLATE_USAGE)
+			return
+		}
+		t, ok, err := templates.GetTemplate(msg.Chat.ID, templateKey(fields[2]))
+		if err != nil || !ok {
+			rejectCommand(bot, ctx, msg, TEMPLATE_404)
+			return
+		}
+		if t.OwnerID != msg.From.ID && !isAdmin(bot, ctx, msg.Chat.ID, msg.From) {
+			rejectCommand(bot, ctx, msg, EDIT_FORBIDDEN)
+			return
+		}
+		if err := templates.DeleteTemplate(msg.Chat.ID, t.Key); err != nil {
+			log.Printf("template delete error: %v", err)
+			setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+			return
+		}
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👍")
+
+	default:
+		rejectCommand(bot, ctx, msg, TEMPLATE_USAGE)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyTemplateRoles(t *testing.T) {
+	fs, err := openFileStore(filepath.Join(t.TempDir(), "rallies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := templates
+	defer func() { templates = old }()
+	templates = fs
+
+	roles := []Role{{Name: "танк", Limit: 2}, {Name: "хил", Limit: 2}, {Name: "дд", Limit: 6}}
+	if err := fs.SaveTemplate(Template{ChatID: 1, Key: "рейд", Name: "Рейд", Limit: 10, Roles: roles}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := rallyCmd{Template: "рейд", Date: "пт 21:00"}
+	if err := applyTemplate(&c, 1); err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "Рейд" || c.Limit != 10 || !reflect.DeepEqual(c.Roles, roles) {
+		t.Errorf("got %+v", c)
+	}
+
+	c = rallyCmd{Template: "рейд", Limit: 10, Date: "пт 21:00"}
+	if err := applyTemplate(&c, 1); err != nil || len(c.Roles) != 3 {
+		t.Errorf("matching limit: err = %v, roles = %v", err, c.Roles)
+	}
+
+	c = rallyCmd{Template: "рейд", Limit: 12, Date: "пт 21:00"}
+	if err := applyTemplate(&c, 1); err == nil {
+		t.Error("expected an error for a limit that differs from the role slots")
+	}
+}
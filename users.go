@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mymmrac/telego"
+)
+
+type Entry struct {
+	UserID int64
+	Name   string
+	N      int
+
+	Friend   string `json:",omitempty"`
+	FriendID int64  `json:",omitempty"`
+	Role     string `json:",omitempty"`
+}
+
+type KnownUser struct {
+	ID       int64
+	Username string
+	Name     string
+}
+
+type KnownChat struct {
+	ID      int64
+	Title   string
+	Members []int64 `json:",omitempty"`
+}
+
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		base, n, ok := parseUserInstance(legacy)
+		if !ok {
+			return fmt.Errorf("invalid entry %q", legacy)
+		}
+		*e = Entry{Name: base, N: n}
+		return nil
+	}
+	type plain Entry
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+func userEntry(u *telego.User) Entry {
+	return Entry{UserID: u.ID, Name: displayName(u)}
+}
+
+func mention(userID int64, name string) string {
+	if userID == 0 {
+		return html.EscapeString(name)
+	}
+	return fmt.Sprintf("<a href=\"tg://user?id=%d\">%s</a>", userID, html.EscapeString(name))
+}
+
+func formatEntry(e Entry) string {
+	if e.Friend != "" {
+		return fmt.Sprintf("Друг %s (от %s)", mention(e.FriendID, e.Friend), mention(e.UserID, e.Name))
+	}
+	if e.N == 0 {
+		return mention(e.UserID, e.Name)
+	}
+	return fmt.Sprintf("%s +%d", mention(e.UserID, e.Name), e.N)
+}
+
+func parseFriendEntry(text string) (friend, owner string, ok bool) {
+	rest, found := strings.CutPrefix(strings.TrimSpace(text), "Друг ")
+	if !found || !strings.HasSuffix(rest, ")") {
+		return "", "", false
+	}
+	i := strings.LastIndex(rest, " (от ")
+	if i == -1 {
+		return "", "", false
+	}
+	return rest[:i], strings.TrimSuffix(rest[i+len(" (от "):], ")"), true
+}
+
+func parseEntryText(r Rally, text string) (Entry, bool) {
+	friend, owner, ok := parseFriendEntry(text)
+	if !ok {
+		base, n, ok := parseUserInstance(text)
+		return Entry{Name: base, N: n}, ok
+	}
+	n := 0
+	for _, e := range participants(r) {
+		if e.Name == owner && e.N > n {
+			n = e.N
+		}
+	}
+	return Entry{Name: owner, N: n + 1, Friend: friend}, true
+}
+
+func claimEntries(r *Rally, u *telego.User) bool {
+	name := displayName(u)
+	changed := false
+	for _, list := range [][]Entry{r.SignedUp, r.WaitingList, r.PenciledIn} {
+		for i := range list {
+			e := &list[i]
+			if e.UserID == 0 && e.Name == name {
+				e.UserID = u.ID
+				changed = true
+			}
+			if e.UserID == u.ID && e.Name != name {
+				e.Name = name
+				changed = true
+			}
+		}
+	}
+	if r.InitiatorID == 0 && r.Initiator == name {
+		r.InitiatorID = u.ID
+		changed = true
+	}
+	if r.InitiatorID == u.ID && r.Initiator != name {
+		r.Initiator = name
+		changed = true
+	}
+	return changed
+}
+
+func rememberUser(u *telego.User) {
+	if u == nil || u.IsBot {
+		return
+	}
+	err := users.RememberUser(KnownUser{ID: u.ID, Username: strings.ToLower(u.Username), Name: displayName(u)})
+	if err != nil {
+		log.Printf("remember user error: %v", err)
+	}
+}
+
+func rememberChat(msg *telego.Message) {
+	if msg.From == nil || msg.From.IsBot || msg.Chat.Type == telego.ChatTypePrivate {
+		return
+	}
+	if err := chats.RememberChat(KnownChat{ID: msg.Chat.ID, Title: msg.Chat.Title}, msg.From.ID); err != nil {
+		log.Printf("remember chat error: %v", err)
+	}
+}
+
+func resolveUserRef(ref string) (int64, bool) {
+	ref = strings.TrimSpace(ref)
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		return id, true
+	}
+	if !strings.HasPrefix(ref, "@") {
+		return 0, false
+	}
+	u, ok, err := users.LookupUsername(strings.ToLower(strings.TrimPrefix(ref, "@")))
+	if err != nil {
+		log.Printf("lookup user error: %v", err)
+		return 0, false
+	}
+	return u.ID, ok
+}
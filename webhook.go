@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+)
+
+const (
+	MODE_POLLING        = "polling"
+	MODE_WEBHOOK        = "webhook"
+	DEFAULT_LISTEN      = ":8080"
+	SECRET_HEADER       = "X-Telegram-Bot-Api-Secret-Token"
+	WEBHOOK_BODY_LIMIT  = 1 << 20
+	WEBHOOK_SHUTDOWN    = 10 * time.Second
+	WEBHOOK_READ_LIMIT  = 30 * time.Second
+	WEBHOOK_UPDATES_BUF = 100
+)
+
+type webhookSink struct {
+	mu      sync.RWMutex
+	closed  bool
+	updates chan telego.Update
+}
+
+func (s *webhookSink) push(ctx context.Context, u telego.Update) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.updates <- u:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *webhookSink) close() {
+	s.mu.Lock()
+	s.closed = true
+	close(s.updates)
+	s.mu.Unlock()
+}
+
+type webhookConfig struct {
+	URL      string
+	Listen   string
+	Path     string
+	Secret   string
+	CertFile string
+	KeyFile  string
+}
+
+func loadWebhookConfig() (webhookConfig, error) {
+	wh := webhookConfig{
+		URL:      getenv("WEBHOOK_URL", ""),
+		Listen:   getenv("WEBHOOK_LISTEN", DEFAULT_LISTEN),
+		Secret:   getenv("WEBHOOK_SECRET", ""),
+		CertFile: getenv("WEBHOOK_CERT", ""),
+		KeyFile:  getenv("WEBHOOK_KEY", ""),
+	}
+	if wh.URL == "" {
+		return wh, errors.New("WEBHOOK_URL is required in webhook mode")
+	}
+	u, err := url.Parse(wh.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return wh, fmt.Errorf("WEBHOOK_URL must be an https URL, got %q", wh.URL)
+	}
+	wh.Path = getenv("WEBHOOK_PATH", u.Path)
+	if wh.Path == "" {
+		wh.Path = "/"
+	}
+	if (wh.CertFile == "") != (wh.KeyFile == "") {
+		return wh, errors.New("WEBHOOK_CERT and WEBHOOK_KEY must be set together")
+	}
+	if wh.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return wh, err
+		}
+		wh.Secret = hex.EncodeToString(buf)
+	}
+	return wh, nil
+}
+
+func webhookHandler(ctx context.Context, secret string, sink *webhookSink) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(SECRET_HEADER)), []byte(secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, WEBHOOK_BODY_LIMIT))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var u telego.Update
+		if err := json.Unmarshal(body, &u); err != nil {
+			log.Printf("webhook decode error: %v", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if !sink.push(ctx, u) {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func updatesViaWebhook(ctx context.Context, bot *telego.Bot) (<-chan telego.Update, error) {
+	wh, err := loadWebhookConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &webhookSink{updates: make(chan telego.Update, WEBHOOK_UPDATES_BUF)}
+	mux := http.NewServeMux()
+	mux.Handle(wh.Path, webhookHandler(ctx, wh.Secret, sink))
+	srv := &http.Server{
+		Addr:              wh.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: WEBHOOK_READ_LIMIT,
+		ReadTimeout:       WEBHOOK_READ_LIMIT,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		var err error
+		if wh.CertFile != "" {
+			err = srv.ListenAndServeTLS(wh.CertFile, wh.KeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+		close(serveErr)
+	}()
+
+	err = bot.SetWebhook(ctx, &telego.SetWebhookParams{
+		URL:         wh.URL,
+		SecretToken: wh.Secret,
+	})
+	if err != nil {
+		_ = srv.Close()
+		return nil, fmt.Errorf("set webhook: %w", err)
+	}
+	log.Printf("Webhook listening on %s%s", wh.Listen, wh.Path)
+
+	go func() {
+		defer sink.close()
+		select {
+		case <-ctx.Done():
+		case err, ok := <-serveErr:
+			if ok {
+				log.Printf("webhook server error: %v", err)
+			}
+			return
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), WEBHOOK_SHUTDOWN)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("webhook shutdown error: %v", err)
+		}
+	}()
+	return sink.updates, nil
+}
+
+func updatesViaPolling(ctx context.Context, bot *telego.Bot) (<-chan telego.Update, error) {
+	if err := bot.DeleteWebhook(ctx, &telego.DeleteWebhookParams{}); err != nil {
+		return nil, fmt.Errorf("delete webhook: %w", err)
+	}
+	return bot.UpdatesViaLongPolling(
+		ctx,
+		&telego.GetUpdatesParams{
+			Timeout: 120,
+			Limit:   100,
+			Offset:  0,
+		},
+		telego.WithLongPollingRetryTimeout(10*time.Second),
+	)
+}
+
+func receiveUpdates(ctx context.Context, bot *telego.Bot) (<-chan telego.Update, error) {
+	switch mode := getenv("BOT_MODE", MODE_POLLING); mode {
+	case MODE_POLLING:
+		return updatesViaPolling(ctx, bot)
+	case MODE_WEBHOOK:
+		return updatesViaWebhook(ctx, bot)
+	default:
+		return nil, fmt.Errorf("unknown BOT_MODE %q, expected %s or %s", mode, MODE_POLLING, MODE_WEBHOOK)
+	}
+}
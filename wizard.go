@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+const (
+	WIZARD_PREFIX      = "wz:"
+	WIZARD_TIMEOUT     = 30 * time.Minute
+	START_MSG          = "Привет! Я помогаю собирать людей на игры и встречи.\n/new — создать сбор пошагово\n/сбор <название> <лимит> <дата> [время] — создать сбор одной строкой в чате\n/notify — включить или выключить уведомления о ваших сборах"
+	WIZARD_DM_FAIL     = "Не могу написать вам в личку. Откройте @%s, нажмите «Старт» и повторите /new"
+	WIZARD_NO_CHATS    = "Я пока не видел вас ни в одном чате. Отправьте /new прямо в нужном чате или теме."
+	WIZARD_EXPIRED     = "⌛ Время вышло, начните заново: /new"
+	WIZARD_CANCELLED   = "Создание сбора отменено"
+	WIZARD_CHAT_MSG    = "В какой чат опубликовать сбор?"
+	WIZARD_NAME_MSG    = "Как называется сбор?"
+	WIZARD_DATE_MSG    = "Выберите день или напишите дату (31.12, пт, завтра 19:00):"
+	WIZARD_TIME_MSG    = "Во сколько? Выберите или напишите время (21:00):"
+	WIZARD_LIMIT_MSG   = "Сколько мест? Выберите или напишите число от %d до %d:"
+	WIZARD_OPTIONS_MSG = "Почти готово. Добавьте детали или публикуйте:"
+	WIZARD_PLACE_MSG   = "Где собираемся?"
+	WIZARD_MIN_MSG     = "Сколько человек нужно как минимум?"
+	WIZARD_DESC_MSG    = "Напишите описание сбора:"
+	WIZARD_BANNED      = "Вы не можете создавать сборы в этом чате"
+	WIZARD_NAME_LEN    = 100
+)
+
+const (
+	STEP_CHAT        = "chat"
+	STEP_NAME        = "name"
+	STEP_DATE        = "date"
+	STEP_TIME        = "time"
+	STEP_LIMIT       = "limit"
+	STEP_OPTIONS     = "options"
+	STEP_PLACE       = "place"
+	STEP_MIN         = "min"
+	STEP_DESCRIPTION = "description"
+)
+
+type wizardState struct {
+	Step        string
+	ChatID      int64
+	ThreadID    int
+	ChatTitle   string
+	Name        string
+	Day         time.Time
+	DateText    string
+	Month       time.Time
+	Limit       int
+	Min         int
+	Place       string
+	Description string
+	MessageID   int
+	Updated     time.Time
+}
+
+var (
+	wizards  = make(map[int64]wizardState)
+	wizardMu sync.Mutex
+)
+
+var monthNames = []string{"Январь", "Февраль", "Март", "Апрель", "Май", "Июнь", "Июль", "Август", "Сентябрь", "Октябрь", "Ноябрь", "Декабрь"}
+
+func getWizard(userID int64) (wizardState, bool) {
+	wizardMu.Lock()
+	defer wizardMu.Unlock()
+	st, ok := wizards[userID]
+	if ok && time.Since(st.Updated) > WIZARD_TIMEOUT {
+		delete(wizards, userID)
+		return wizardState{}, false
+	}
+	return st, ok
+}
+
+func putWizard(userID int64, st wizardState) {
+	st.Updated = time.Now()
+	wizardMu.Lock()
+	wizards[userID] = st
+	wizardMu.Unlock()
+}
+
+func dropWizard(userID int64) {
+	wizardMu.Lock()
+	delete(wizards, userID)
+	wizardMu.Unlock()
+}
+
+func expireWizards(bot *telego.Bot, ctx context.Context, now time.Time) {
+	wizardMu.Lock()
+	expired := make(map[int64]int)
+	for userID, st := range wizards {
+		if now.Sub(st.Updated) > WIZARD_TIMEOUT {
+			expired[userID] = st.MessageID
+			delete(wizards, userID)
+		}
+	}
+	wizardMu.Unlock()
+	for userID, messageID := range expired {
+		if messageID == 0 {
+			continue
+		}
+		_, err := bot.EditMessageText(ctx, &telego.EditMessageTextParams{
+			ChatID:    tu.ID(userID),
+			MessageID: messageID,
+			Text:      WIZARD_EXPIRED,
+		})
+		if err != nil {
+			log.Printf("edit error: %v", err)
+		}
+	}
+}
+
+func wizardButton(text, data string) telego.InlineKeyboardButton {
+	return tu.InlineKeyboardButton(text).WithCallbackData(WIZARD_PREFIX + data)
+}
+
+func wizardCancelRow() []telego.InlineKeyboardButton {
+	return tu.InlineKeyboardRow(wizardButton("Отмена", "cancel").WithStyle("danger"))
+}
+
+func calendarKeyboard(month, now time.Time) *telego.InlineKeyboardMarkup {
+	today := startOfDay(now)
+	first := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, location)
+	prev, next := first.AddDate(0, -1, 0), first.AddDate(0, 1, 0)
+
+	nav := tu.InlineKeyboardRow(wizardButton(" ", "noop"))
+	if first.After(today) {
+		nav[0] = wizardButton("‹", "month:"+prev.Format("2006-01"))
+	}
+	nav = append(nav,
+		wizardButton(fmt.Sprintf("%s %d", monthNames[first.Month()-1], first.Year()), "noop"),
+		wizardButton("›", "month:"+next.Format("2006-01")),
+	)
+	rows := [][]telego.InlineKeyboardButton{nav}
+
+	var head []telego.InlineKeyboardButton
+	for _, d := range []string{"Пн", "Вт", "Ср", "Чт", "Пт", "Сб", "Вс"} {
+		head = append(head, wizardButton(d, "noop"))
+	}
+	rows = append(rows, head)
+
+	week := make([]telego.InlineKeyboardButton, 0, 7)
+	for i := 0; i < (int(first.Weekday())+6)%7; i++ {
+		week = append(week, wizardButton(" ", "noop"))
+	}
+	for day := first; day.Before(next); day = day.AddDate(0, 0, 1) {
+		if day.Before(today) {
+			week = append(week, wizardButton("·", "noop"))
+		} else {
+			week = append(week, wizardButton(strconv.Itoa(day.Day()), "day:"+day.Format("2006-01-02")))
+		}
+		if len(week) == 7 {
+			rows = append(rows, week)
+			week = make([]telego.InlineKeyboardButton, 0, 7)
+		}
+	}
+	if len(week) > 0 {
+		for len(week) < 7 {
+			week = append(week, wizardButton(" ", "noop"))
+		}
+		rows = append(rows, week)
+	}
+	rows = append(rows, wizardCancelRow())
+	return tu.InlineKeyboard(rows...)
+}
+
+func timeKeyboard() *telego.InlineKeyboardMarkup {
+	var row []telego.InlineKeyboardButton
+	for _, t := range []string{"18:00", "19:00", "20:00", "21:00"} {
+		row = append(row, wizardButton(t, "time:"+t))
+	}
+	return tu.InlineKeyboard(
+		row,
+		tu.InlineKeyboardRow(wizardButton("Весь день", "time:")),
+		wizardCancelRow(),
+	)
+}
+
+func limitKeyboard(s Settings) *telego.InlineKeyboardMarkup {
+	var rows [][]telego.InlineKeyboardButton
+	var row []telego.InlineKeyboardButton
+	for _, n := range []int{2, 4, 6, 8, 10, 12, 16, 20, 25, 30} {
+		if !s.validLimit(n) {
+			continue
+		}
+		row = append(row, wizardButton(strconv.Itoa(n), "limit:"+strconv.Itoa(n)))
+		if len(row) == 5 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	rows = append(rows, wizardCancelRow())
+	return tu.InlineKeyboard(rows...)
+}
+
+func optionsKeyboard() *telego.InlineKeyboardMarkup {
+	return tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			wizardButton("📍 Место", "opt:"+STEP_PLACE),
+			wizardButton("🎯 Минимум", "opt:"+STEP_MIN),
+			wizardButton("📝 Описание", "opt:"+STEP_DESCRIPTION),
+		),
+		tu.InlineKeyboardRow(wizardButton("Опубликовать", "publish").WithStyle("success")),
+		wizardCancelRow(),
+	)
+}
+
+func chatKeyboard(list []KnownChat) *telego.InlineKeyboardMarkup {
+	var rows [][]telego.InlineKeyboardButton
+	for _, c := range list {
+		rows = append(rows, tu.InlineKeyboardRow(wizardButton(c.Title, "chat:"+strconv.FormatInt(c.ID, 10))))
+	}
+	rows = append(rows, wizardCancelRow())
+	return tu.InlineKeyboard(rows...)
+}
+
+func wizardSummary(st wizardState) string {
+	var sb strings.Builder
+	if st.ChatTitle != "" {
+		sb.WriteString(fmt.Sprintf("💬 Чат: %s\n", html.EscapeString(st.ChatTitle)))
+	}
+	if st.Name != "" {
+		sb.WriteString(fmt.Sprintf("🎉 Сбор: %s\n", html.EscapeString(st.Name)))
+	}
+	if st.DateText != "" {
+		sb.WriteString(fmt.Sprintf("📅 Дата: %s\n", html.EscapeString(st.DateText)))
+	} else if !st.Day.IsZero() {
+		sb.WriteString(fmt.Sprintf("📅 Дата: %s\n", st.Day.Format("02.01.2006")))
+	}
+	if st.Limit > 0 {
+		sb.WriteString(fmt.Sprintf("🔢 Лимит: %d\n", st.Limit))
+	}
+	if st.Min > 0 {
+		sb.WriteString(fmt.Sprintf("🎯 Минимум: %d\n", st.Min))
+	}
+	if st.Place != "" {
+		sb.WriteString(fmt.Sprintf("📍 Место: %s\n", html.EscapeString(st.Place)))
+	}
+	if st.Description != "" {
+		sb.WriteString(fmt.Sprintf("📝 Описание: %s\n", html.EscapeString(st.Description)))
+	}
+	if sb.Len() > 0 {
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func wizardPrompt(userID int64, st wizardState, now time.Time) (string, *telego.InlineKeyboardMarkup) {
+	text := wizardSummary(st)
+	switch st.Step {
+	case STEP_CHAT:
+		list, err := chats.ChatsOf(userID)
+		if err != nil {
+			log.Printf("list chats error: %v", err)
+		}
+		return text + WIZARD_CHAT_MSG, chatKeyboard(list)
+	case STEP_NAME:
+		return text + WIZARD_NAME_MSG, tu.InlineKeyboard(wizardCancelRow())
+	case STEP_DATE:
+		month := st.Month
+		if month.IsZero() {
+			month = now
+		}
+		return text + WIZARD_DATE_MSG, calendarKeyboard(month, now)
+	case STEP_TIME:
+		return text + WIZARD_TIME_MSG, timeKeyboard()
+	case STEP_LIMIT:
+		s := settingsFor(st.ChatID)
+		return text + fmt.Sprintf(WIZARD_LIMIT_MSG, s.LimitMin, s.LimitMax), limitKeyboard(s)
+	case STEP_PLACE:
+		return text + WIZARD_PLACE_MSG, tu.InlineKeyboard(wizardCancelRow())
+	case STEP_MIN:
+		return text + WIZARD_MIN_MSG, tu.InlineKeyboard(wizardCancelRow())
+	case STEP_DESCRIPTION:
+		return text + WIZARD_DESC_MSG, tu.InlineKeyboard(wizardCancelRow())
+	}
+	return text + WIZARD_OPTIONS_MSG, optionsKeyboard()
+}
+
+func sendWizardPrompt(bot *telego.Bot, ctx context.Context, userID int64, st wizardState) (wizardState, error) {
+	if st.MessageID != 0 {
+		_, _ = bot.EditMessageReplyMarkup(ctx, &telego.EditMessageReplyMarkupParams{
+			ChatID:    tu.ID(userID),
+			MessageID: st.MessageID,
+		})
+	}
+	text, markup := wizardPrompt(userID, st, time.Now().In(location))
+	sent, err := bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID:      tu.ID(userID),
+		Text:        text,
+		ParseMode:   "HTML",
+		ReplyMarkup: markup,
+	})
+	if err != nil {
+		return st, err
+	}
+	st.MessageID = sent.MessageID
+	putWizard(userID, st)
+	return st, nil
+}
+
+func editWizardPrompt(bot *telego.Bot, ctx context.Context, userID int64, st wizardState) {
+	putWizard(userID, st)
+	text, markup := wizardPrompt(userID, st, time.Now().In(location))
+	_, err := bot.EditMessageText(ctx, &telego.EditMessageTextParams{
+		ChatID:      tu.ID(userID),
+		MessageID:   st.MessageID,
+		Text:        text,
+		ParseMode:   "HTML",
+		ReplyMarkup: markup,
+	})
+	if err != nil && !isNotModified(err) {
+		log.Printf("edit error: %v", err)
+	}
+}
+
+func wizardNotice(bot *telego.Bot, ctx context.Context, userID int64, text string) {
+	_, _ = bot.SendMessage(ctx, &telego.SendMessageParams{
+		ChatID: tu.ID(userID),
+		Text:   text,
+	})
+}
+
+func handleNew(bot *telego.Bot, ctx context.Context, msg *telego.Message) {
+	if msg.From == nil {
+		return
+	}
+	userID := msg.From.ID
+	st := wizardState{Step: STEP_NAME}
+
+	if old, ok := getWizard(userID); ok && old.MessageID != 0 {
+		_, _ = bot.EditMessageReplyMarkup(ctx, &telego.EditMessageReplyMarkupParams{
+			ChatID:    tu.ID(userID),
+			MessageID: old.MessageID,
+		})
+	}
+
+	if msg.Chat.Type != telego.ChatTypePrivate {
+		if isBanned(msg.Chat.ID, userID) {
+			setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👎")
+			return
+		}
+		st.ChatID, st.ThreadID, st.ChatTitle = msg.Chat.ID, msg.MessageThreadID, msg.Chat.Title
+		if _, err := sendWizardPrompt(bot, ctx, userID, st); err != nil {
+			log.Printf("send error: %v", err)
+			rejectCommand(bot, ctx, msg, fmt.Sprintf(WIZARD_DM_FAIL, botUsername))
+			return
+		}
+		setReaction(bot, ctx, msg.Chat.ID, msg.MessageID, "👍")
+		return
+	}
+
+	list, err := chats.ChatsOf(userID)
+	if err != nil {
+		log.Printf("list chats error: %v", err)
+	}
+	switch len(list) {
+	case 0:
+		wizardNotice(bot, ctx, userID, WIZARD_NO_CHATS)
+		return
+	case 1:
+		st.ChatID, st.ChatTitle = list[0].ID, list[0].Title
+	default:
+		st.Step = STEP_CHAT
+	}
+	if _, err := sendWizardPrompt(bot, ctx, userID, st); err != nil {
+		log.Printf("send error: %v", err)
+	}
+}
+
+func handleWizardMessage(bot *telego.Bot, ctx context.Context, msg *telego.Message) bool {
+	if msg.From == nil {
+		return false
+	}
+	userID := msg.From.ID
+	text := strings.TrimSpace(msg.Text)
+	st, ok := getWizard(userID)
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(text, "/cancel") {
+		dropWizard(userID)
+		wizardNotice(bot, ctx, userID, WIZARD_CANCELLED)
+		return true
+	}
+	if text == "" || strings.HasPrefix(text, "/") {
+		return false
+	}
+
+	now := time.Now().In(location)
+	switch st.Step {
+	case STEP_NAME:
+		if len([]rune(text)) > WIZARD_NAME_LEN {
+			wizardNotice(bot, ctx, userID, fmt.Sprintf("Название длиннее %d символов", WIZARD_NAME_LEN))
+			return true
+		}
+		st.Name = text
+		st.Step = STEP_DATE
+	case STEP_DATE:
+		start, allDay, err := parseDate(text, now)
+		if err != nil {
+			wizardNotice(bot, ctx, userID, err.Error())
+			return true
+		}
+		st.Day = startOfDay(start)
+		if allDay {
+			st.Step = STEP_TIME
+			break
+		}
+		st.DateText = start.Format("02.01.2006 15:04")
+		st.Step = STEP_LIMIT
+	case STEP_TIME:
+		h, m, ok := parseClock(text)
+		if !ok {
+			wizardNotice(bot, ctx, userID, WIZARD_TIME_MSG)
+			return true
+		}
+		dateText, err := wizardDateText(st.Day, fmt.Sprintf("%02d:%02d", h, m), now)
+		if err != nil {
+			wizardNotice(bot, ctx, userID, err.Error())
+			return true
+		}
+		st.DateText = dateText
+		st.Step = STEP_LIMIT
+	case STEP_LIMIT:
+		n, err := strconv.Atoi(text)
+		if s := settingsFor(st.ChatID); err != nil || !s.validLimit(n) {
+			wizardNotice(bot, ctx, userID, s.limitRangeMsg())
+			return true
+		}
+		st.Limit = n
+		if st.Min > n {
+			st.Min = 0
+		}
+		st.Step = STEP_OPTIONS
+	case STEP_PLACE:
+		st.Place = text
+		st.Step = STEP_OPTIONS
+	case STEP_MIN:
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 1 || n > st.Limit {
+			wizardNotice(bot, ctx, userID, MIN_RANGE_MSG)
+			return true
+		}
+		st.Min = n
+		st.Step = STEP_OPTIONS
+	case STEP_DESCRIPTION:
+		st.Description = text
+		st.Step = STEP_OPTIONS
+	default:
+		return false
+	}
+	if _, err := sendWizardPrompt(bot, ctx, userID, st); err != nil {
+		log.Printf("send error: %v", err)
+	}
+	return true
+}
+
+func wizardDateText(day time.Time, clock string, now time.Time) (string, error) {
+	text := day.Format("02.01.2006")
+	if clock != "" {
+		text += " " + clock
+	}
+	if _, _, err := parseDate(text, now); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+func publishWizard(bot *telego.Bot, ctx context.Context, u *telego.User, st wizardState) error {
+	if isBanned(st.ChatID, u.ID) {
+		return fmt.Errorf(WIZARD_BANNED)
+	}
+	rally := Rally{
+		Name:        st.Name,
+		Limit:       st.Limit,
+		Min:         st.Min,
+		Description: st.Description,
+		Place:       st.Place,
+		Initiator:   displayName(u),
+		InitiatorID: u.ID,
+		ChatID:      st.ChatID,
+		ThreadID:    st.ThreadID,
+		Status:      STATUS_OPEN,
+	}
+	if err := setRallyDate(&rally, st.DateText, time.Now().In(location)); err != nil {
+		return err
+	}
+	if _, err := publishRally(bot, ctx, rally); err != nil {
+		log.Printf("send error: %v", err)
+		return fmt.Errorf("Не удалось опубликовать сбор в «%s»", st.ChatTitle)
+	}
+	return nil
+}
+
+func handleWizardCallback(bot *telego.Bot, ctx context.Context, cb *telego.CallbackQuery) {
+	userID := cb.From.ID
+	st, ok := getWizard(userID)
+	msg := cb.Message
+	if !ok || msg == nil || msg.GetMessageID() != st.MessageID {
+		sendCallback(bot, ctx, cb.ID, WIZARD_EXPIRED)
+		return
+	}
+	action, arg, _ := strings.Cut(strings.TrimPrefix(cb.Data, WIZARD_PREFIX), ":")
+	now := time.Now().In(location)
+
+	switch action {
+	case "noop":
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	case "cancel":
+		dropWizard(userID)
+		_, _ = bot.EditMessageText(ctx, &telego.EditMessageTextParams{
+			ChatID:    tu.ID(userID),
+			MessageID: st.MessageID,
+			Text:      WIZARD_CANCELLED,
+		})
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	case "chat":
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || st.Step != STEP_CHAT {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		list, err := chats.ChatsOf(userID)
+		if err != nil {
+			log.Printf("list chats error: %v", err)
+		}
+		st.ChatID = 0
+		for _, c := range list {
+			if c.ID == id {
+				st.ChatID, st.ChatTitle = c.ID, c.Title
+			}
+		}
+		if st.ChatID == 0 {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		st.Step = STEP_NAME
+	case "month":
+		month, err := time.ParseInLocation("2006-01", arg, location)
+		if err != nil || st.Step != STEP_DATE {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		st.Month = month
+	case "day":
+		day, err := time.ParseInLocation("2006-01-02", arg, location)
+		if err != nil || st.Step != STEP_DATE || day.Before(startOfDay(now)) {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		st.Day = day
+		st.Step = STEP_TIME
+	case "time":
+		if st.Step != STEP_TIME {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		dateText, err := wizardDateText(st.Day, arg, now)
+		if err != nil {
+			sendCallback(bot, ctx, cb.ID, err.Error())
+			return
+		}
+		st.DateText = dateText
+		st.Step = STEP_LIMIT
+	case "limit":
+		n, err := strconv.Atoi(arg)
+		if err != nil || st.Step != STEP_LIMIT || !settingsFor(st.ChatID).validLimit(n) {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		st.Limit = n
+		if st.Min > n {
+			st.Min = 0
+		}
+		st.Step = STEP_OPTIONS
+	case "opt":
+		if st.Step != STEP_OPTIONS || arg != STEP_PLACE && arg != STEP_MIN && arg != STEP_DESCRIPTION {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		st.Step = arg
+	case "publish":
+		if st.Step != STEP_OPTIONS {
+			sendSilentCallback(bot, ctx, cb.ID)
+			return
+		}
+		if _, _, err := parseDate(st.DateText, now); err != nil {
+			sendCallback(bot, ctx, cb.ID, err.Error())
+			st.Step, st.DateText, st.Day = STEP_DATE, "", time.Time{}
+			editWizardPrompt(bot, ctx, userID, st)
+			return
+		}
+		if err := publishWizard(bot, ctx, &cb.From, st); err != nil {
+			sendCallback(bot, ctx, cb.ID, err.Error())
+			return
+		}
+		dropWizard(userID)
+		_, _ = bot.EditMessageText(ctx, &telego.EditMessageTextParams{
+			ChatID:    tu.ID(userID),
+			MessageID: st.MessageID,
+			Text:      wizardSummary(st) + "✅ Сбор опубликован",
+			ParseMode: "HTML",
+		})
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	default:
+		sendSilentCallback(bot, ctx, cb.ID)
+		return
+	}
+	editWizardPrompt(bot, ctx, userID, st)
+	sendSilentCallback(bot, ctx, cb.ID)
+}